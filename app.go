@@ -1,7 +1,10 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/gorilla/mux"
@@ -10,20 +13,34 @@ import (
 	"math"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
 type Settings struct {
 	RedisUrl       string
 	RedisPrefix    string
+	Store          string
+	Snapshot       string
+	BoltPath       string
+	SqlDriver      string
+	SqlDsn         string
+	Retention      Retention
 	RestrictDomain string
 	Redirect404    string
 	UrlLength      int
+	BotPolicy      string
 }
 
 type ApiAddRequest struct {
-	LongUrl string
+	LongUrl     string
+	Parameters  map[string]string
+	Passthrough bool
+	Precedence  string
 }
 
 func ApiAddHandler(resp http.ResponseWriter, req *http.Request) {
@@ -49,7 +66,16 @@ func ApiAddHandler(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	gosUrl, err := NewUrl(message.LongUrl)
+	parameters := url.Values{}
+	for name, value := range message.Parameters {
+		parameters.Set(name, value)
+	}
+
+	gosUrl, err := NewUrl(message.LongUrl, RedirectOptions{
+		Parameters:  parameters.Encode(),
+		Passthrough: message.Passthrough,
+		Precedence:  message.Precedence,
+	})
 	if err != nil {
 		RenderJsonError(resp, req, err.Error(), http.StatusBadRequest)
 		return
@@ -66,7 +92,11 @@ func ApiAddHandler(resp http.ResponseWriter, req *http.Request) {
 }
 
 func AddHandler(resp http.ResponseWriter, req *http.Request) {
-	gosUrl, err := NewUrl(req.FormValue("url"))
+	gosUrl, err := NewUrl(req.FormValue("url"), RedirectOptions{
+		Parameters:  req.FormValue("parameters"),
+		Passthrough: req.FormValue("passthrough") != "",
+		Precedence:  req.FormValue("precedence"),
+	})
 	if err != nil {
 		Render(resp, req, "home", map[string]string{"error": err.Error()})
 		return
@@ -102,8 +132,8 @@ func RedirectHandler(resp http.ResponseWriter, req *http.Request) {
 	}
 
 	request, _ := requestParser.Parse(req)
-	go gosUrl.Hit(request)
-	http.Redirect(resp, req, gosUrl.Destination, http.StatusMovedPermanently)
+	hitQueue.Push(gosUrl, request)
+	http.Redirect(resp, req, gosUrl.Target(req.URL.Query()), http.StatusMovedPermanently)
 }
 
 func StatHandler(resp http.ResponseWriter, req *http.Request) {
@@ -129,19 +159,46 @@ func StatHandler(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	var body []byte
+	var (
+		body    []byte
+		stats   interface{}
+		buckets []Bucket
+	)
+
+	location, err := requestLocation(req)
+	if err == nil && vars["what"] != "sources" {
+		buckets, err = PeriodBuckets(vars["what"], location)
+	}
 
 	switch {
+	case err != nil:
 	case vars["what"] == "sources":
-		stats, err := gosUrl.Sources(false)
+		var window *Bucket
+		var sources SourceStats
+		window, err = requestWindow(req, location)
 		if err == nil {
-			body, err = json.Marshal(stats)
+			sources, err = gosUrl.Sources(window, false)
 		}
-	default:
-		stats, err := gosUrl.Stats(vars["what"])
-		if err == nil {
-			body, err = json.Marshal(stats)
+		if err == nil && req.FormValue("domain") != "" {
+			sources.Referrers, err = gosUrl.DomainReferrers(req.FormValue("domain"), window, false)
+		}
+		if country := req.FormValue("country"); err == nil && country != "" {
+			sources.Regions, err = gosUrl.CountryRegions(country, window, false)
+			if err == nil {
+				sources.Cities, err = gosUrl.CountryCities(country, window, false)
+			}
 		}
+		stats = sources
+	case req.FormValue("series") == "uniques":
+		stats, err = gosUrl.Uniques(buckets)
+	case req.FormValue("series") == "bots":
+		stats, err = gosUrl.BotHits(buckets)
+	default:
+		stats, err = gosUrl.Stats(buckets)
+	}
+
+	if err == nil {
+		body, err = json.Marshal(stats)
 	}
 
 	if err != nil {
@@ -152,6 +209,73 @@ func StatHandler(resp http.ResponseWriter, req *http.Request) {
 	resp.Write(body)
 }
 
+func RangeHandler(resp http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	gosUrl, err := GetUrl(vars["id"])
+	if err != nil {
+		RenderJsonError(resp, req, err.Error(), http.StatusInternalServerError)
+		return
+	} else if gosUrl == nil {
+		RenderJsonError(resp, req, "No URL was found with that goshorty code", http.StatusNotFound)
+		return
+	}
+
+	from, err := parseTimestamp(req.FormValue("from"))
+	if err != nil {
+		RenderJsonError(resp, req, "Invalid from: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	to := time.Now()
+	if req.FormValue("to") != "" {
+		to, err = parseTimestamp(req.FormValue("to"))
+		if err != nil {
+			RenderJsonError(resp, req, "Invalid to: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	granularity := req.FormValue("granularity")
+	if granularity == "" {
+		granularity = "day"
+	}
+
+	location, err := requestLocation(req)
+	if err != nil {
+		RenderJsonError(resp, req, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	buckets, err := RangeBuckets(from, to, granularity, location)
+	if err != nil {
+		RenderJsonError(resp, req, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var stats Stats
+	switch req.FormValue("series") {
+	case "uniques":
+		stats, err = gosUrl.Uniques(buckets)
+	case "bots":
+		stats, err = gosUrl.BotHits(buckets)
+	default:
+		stats, err = gosUrl.Stats(buckets)
+	}
+	if err != nil {
+		RenderJsonError(resp, req, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	body, err := json.Marshal(stats)
+	if err != nil {
+		RenderJsonError(resp, req, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(body)
+}
+
 func StatsHandler(resp http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	gosUrl, err := GetUrl(vars["id"])
@@ -169,11 +293,24 @@ func StatsHandler(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	uniques, err := gosUrl.Visitors()
+	if err != nil {
+		RenderError(resp, req, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := requestLocation(req); err != nil {
+		RenderError(resp, req, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	Render(resp, req, "stats", map[string]string{
-		"id":   gosUrl.Id,
-		"url":  gosUrl.Destination,
-		"when": relativeTime(time.Now().Sub(gosUrl.Created)),
-		"hits": fmt.Sprintf("%d", hits),
+		"id":      gosUrl.Id,
+		"url":     gosUrl.Destination,
+		"when":    relativeTime(time.Now().Sub(gosUrl.Created)),
+		"hits":    fmt.Sprintf("%d", hits),
+		"uniques": fmt.Sprintf("%d", uniques),
+		"tz":      req.FormValue("tz"),
 	})
 }
 
@@ -181,6 +318,64 @@ func HomeHandler(resp http.ResponseWriter, req *http.Request) {
 	Render(resp, req, "home", nil)
 }
 
+// requestLocation returns the time zone statistics are shown in, taken
+// from the IANA name given on the tz parameter, or the server's own zone.
+func requestLocation(req *http.Request) (*time.Location, error) {
+	tz := req.FormValue("tz")
+	if tz == "" {
+		return time.Local, nil
+	}
+
+	location, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid time zone: %s", tz))
+	}
+	return location, nil
+}
+
+// requestWindow returns the span of time given either as a period on the
+// period parameter, or as a range on the from and to parameters. It returns
+// nil when none is given.
+func requestWindow(req *http.Request, location *time.Location) (*Bucket, error) {
+	if period := req.FormValue("period"); period != "" {
+		buckets, err := PeriodBuckets(period, location)
+		if err != nil {
+			return nil, err
+		}
+		return &Bucket{From: buckets[0].From, To: buckets[len(buckets)-1].To}, nil
+	} else if req.FormValue("from") == "" {
+		return nil, nil
+	}
+
+	from, err := parseTimestamp(req.FormValue("from"))
+	if err != nil {
+		return nil, errors.New("Invalid from: " + err.Error())
+	}
+
+	to := time.Now()
+	if req.FormValue("to") != "" {
+		to, err = parseTimestamp(req.FormValue("to"))
+		if err != nil {
+			return nil, errors.New("Invalid to: " + err.Error())
+		}
+	}
+
+	if to.Before(from) {
+		return nil, errors.New("The end of the range can't be before its start")
+	}
+	return &Bucket{From: from, To: to}, nil
+}
+
+// parseTimestamp accepts either seconds since the epoch or an RFC 3339 date.
+func parseTimestamp(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, errors.New("No timestamp given")
+	} else if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
 func relativeTime(duration time.Duration) string {
 	hours := int64(math.Abs(duration.Hours()))
 	minutes := int64(math.Abs(duration.Minutes()))
@@ -216,18 +411,42 @@ var (
 	router        = mux.NewRouter()
 	settings      = new(Settings)
 	requestParser *RequestParser
+	hitQueue      *HitQueue
 )
 
 func main() {
 	var (
 		geoDb       string
+		geoDbV6     string
+		geoDbAsn    string
+		geoWatch    time.Duration
+		salt        string
+		bots        string
+		proxies     string
+		devIp       string
+		privacy     Privacy
 		redisHost   string
 		redisPort   int
 		redisPrefix string
 		regex       string
 		port        int
+		migrate     bool
+		hitWorkers  int
+		hitQueueLen int
+		hitBatch    int
+		metricsAddr string
+		compact     time.Duration
+
+		retentionMinute time.Duration
+		retentionHour   time.Duration
+		retentionDay    time.Duration
 	)
 
+	flag.StringVar(&settings.Store, "store", "redis", "Storage backend to use (redis, memory, bolt, sql)")
+	flag.StringVar(&settings.Snapshot, "snapshot", "", "File where the memory store is loaded from and saved to on shutdown (leave empty to disable)")
+	flag.StringVar(&settings.BoltPath, "bolt_db", "./goshorty.db", "Location of the database file used by the bolt store")
+	flag.StringVar(&settings.SqlDriver, "sql_driver", "sqlite3", "Database driver used by the sql store (sqlite3, postgres)")
+	flag.StringVar(&settings.SqlDsn, "sql_dsn", "./goshorty.sqlite", "Data source name used by the sql store")
 	flag.StringVar(&redisHost, "redis_host", "", "Redis host (leave empty for localhost)")
 	flag.IntVar(&redisPort, "redis_port", 6379, "Redis port")
 	flag.StringVar(&redisPrefix, "redis_prefix", "goshorty:", "Redis prefix to use")
@@ -236,23 +455,113 @@ func main() {
 	flag.IntVar(&settings.UrlLength, "length", 5, "How many characters should the short code have")
 	flag.StringVar(&regex, "regex", "[A-Za-z0-9]{%d}", "Regular expression to match route for accessing a short code. %d is replaced with <length> setting")
 	flag.IntVar(&port, "port", 8080, "Port where server is listening on")
-	flag.StringVar(&geoDb, "geo_db", "./GeoIP.dat", "Location to the MaxMind GeoIP country database file")
+	flag.BoolVar(&migrate, "migrate_stats", false, "Convert statistics kept by older versions on the redis store to the current layout, and exit")
+	flag.IntVar(&hitWorkers, "hit_workers", 4, "How many workers record hits in the background")
+	flag.IntVar(&hitQueueLen, "hit_queue", 10000, "How many hits can wait to be recorded before new ones are dropped")
+	flag.IntVar(&hitBatch, "hit_batch", 100, "Maximum number of hits recorded on a single store round trip")
+	flag.StringVar(&metricsAddr, "metrics_addr", "localhost:6060", "Address where hit queue metrics are served on /debug/vars, apart from the public server (leave empty to disable)")
+	flag.DurationVar(&compact, "compact_interval", time.Hour, "How often statistics past their retention are dropped, for stores that don't expire them on their own")
+	flag.DurationVar(&retentionMinute, "retention_minute", 48*time.Hour, "For how long statistics per 5 minutes are kept (0 keeps them forever)")
+	flag.DurationVar(&retentionHour, "retention_hour", 90*24*time.Hour, "For how long statistics per hour are kept (0 keeps them forever)")
+	flag.DurationVar(&retentionDay, "retention_day", 0, "For how long statistics per day are kept (0 keeps them forever)")
+	flag.StringVar(&geoDb, "geo_db", "./GeoIP.dat", "Location to the MaxMind geolocation database file, either a GeoIP2 or GeoLite2 .mmdb file or a legacy GeoIP.dat country one")
+	flag.StringVar(&geoDbAsn, "geo_asn_db", "", "Location to a MaxMind GeoLite2 or GeoIP2 ASN .mmdb database file (leave empty to record no networks)")
+	flag.StringVar(&geoDbV6, "geo_db_v6", "", "Location to the legacy MaxMind GeoIPv6 country database file, used along with a legacy -geo_db (leave empty to record no country for IPv6 clients)")
+	flag.StringVar(&settings.BotPolicy, "bot_policy", "separate", "What to do with hits by bots (count along with everyone else, separate them on a series of their own, ignore them)")
+	flag.StringVar(&bots, "bot_signatures", "", "Comma separated list of extra user agent fragments identifying bots")
+	flag.StringVar(&proxies, "trusted_proxies", "", "Comma separated list of networks, in CIDR notation, of proxies trusted to tell the client address through the Forwarded, X-Forwarded-For and X-Real-Ip headers")
+	flag.DurationVar(&geoWatch, "geo_watch", time.Minute, "How often geolocation database files are checked for changes, to load them again (0 disables it, they are still loaded again on SIGHUP)")
+	flag.StringVar(&devIp, "dev_ip", "", "Address used in place of local clients, to try geolocation out during development")
+	flag.BoolVar(&privacy.TruncateIp, "privacy_truncate_ip", false, "Truncate client addresses before locating or fingerprinting them")
+	flag.BoolVar(&privacy.HonorOptOut, "privacy_opt_out", false, "Only count the hit, with no further statistics, for clients sending DNT or Sec-GPC")
+	flag.BoolVar(&privacy.StripReferrerQuery, "privacy_strip_referrer_query", false, "Drop query strings from referrers")
+	flag.StringVar(&salt, "visitor_salt", "", "Secret mixed into unique visitor fingerprints (leave empty for a random one on every start)")
 
 	flag.Parse()
 
-	var err error
-	requestParser, err = NewRequestParser(geoDb)
+	geoPaths := []string{geoDb, geoDbV6, geoDbAsn}
+	geo, err := LoadGeo(geoPaths)
 	if err != nil {
 		panic(err)
 	}
 
+	requestParser = NewRequestParser(geo)
+	defer requestParser.Close()
+	go GeoReloader(requestParser, geoPaths, geoWatch)
+
+	switch settings.BotPolicy {
+	case "count", "separate", "ignore":
+	default:
+		panic(fmt.Sprintf("Invalid bot policy: %s", settings.BotPolicy))
+	}
+
+	for _, signature := range strings.Split(bots, ",") {
+		if signature = strings.TrimSpace(signature); signature != "" {
+			requestParser.BotSignatures = append(requestParser.BotSignatures, signature)
+		}
+	}
+
+	requestParser.TrustedProxies, err = ParseNetworks(proxies)
+	if err != nil {
+		panic(err)
+	}
+	requestParser.DevIp = devIp
+	requestParser.Privacy = privacy
+
+	requestParser.Salt = salt
+	if requestParser.Salt == "" {
+		random := make([]byte, 16)
+		rand.Read(random)
+		requestParser.Salt = hex.EncodeToString(random)
+	}
+
 	regex = fmt.Sprintf(regex, settings.UrlLength)
 	settings.RedisUrl = fmt.Sprintf("%s:%d", redisHost, redisPort)
 	settings.RedisPrefix = redisPrefix
+	settings.Retention = Retention{
+		"minute": retentionMinute,
+		"hour":   retentionHour,
+		"day":    retentionDay,
+	}
+
+	store, err = NewStore(settings.Store)
+	if err != nil {
+		panic(err)
+	}
+	defer store.Close()
+
+	if migrate {
+		redisStore, ok := store.(*RedisStore)
+		if !ok {
+			panic("Only the redis store needs migrating statistics")
+		}
+		migrated, err := redisStore.Migrate()
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println(fmt.Sprintf("Migrated %d statistics keys", migrated))
+		return
+	}
+
+	hitQueue = NewHitQueue(hitWorkers, hitQueueLen, hitBatch)
+	go Compactor(compact)
+
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		hitQueue.Close()
+		if err := store.Close(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}()
 
 	router.HandleFunc("/api/v1/url", ApiAddHandler).Methods("POST").Name("add")
 	router.HandleFunc("/add", AddHandler).Methods("POST").Name("add")
-	router.HandleFunc("/{id:"+regex+"}+/{what:(hour|day|week|month|year|all|sources)}", StatHandler).Name("stat")
+	router.HandleFunc("/{id:"+regex+"}+/range", RangeHandler).Methods("GET").Name("range")
+	router.HandleFunc("/{id:"+regex+"}+/{what:(hour|day|week|month|year|all|60minutes|24hours|7days|30days|12months|sources)}", StatHandler).Name("stat")
 	router.HandleFunc("/{id:"+regex+"}+", StatsHandler).Name("stats")
 	router.HandleFunc("/{id:"+regex+"}", RedirectHandler).Name("redirect")
 	router.HandleFunc("/", HomeHandler).Name("home")
@@ -260,6 +569,17 @@ func main() {
 		router.PathPrefix("/" + dir + "/").Handler(http.StripPrefix("/"+dir+"/", http.FileServer(http.Dir("assets/"+dir))))
 	}
 
+	if metricsAddr != "" {
+		metrics := http.NewServeMux()
+		metrics.HandleFunc("/debug/vars", MetricsHandler)
+		go func() {
+			fmt.Println(fmt.Sprintf("Metrics are served on %s", metricsAddr))
+			if err := http.ListenAndServe(metricsAddr, metrics); err != nil {
+				fmt.Println(err)
+			}
+		}()
+	}
+
 	fmt.Println(fmt.Sprintf("Server is listening on port %d", port))
 	err = http.ListenAndServe(fmt.Sprintf(":%d", port), router)
 	if err != nil {
@@ -7,6 +7,14 @@
 		return values;
 	};
 
+	var timezone = function() {
+		var tz = $("#stats").attr("data-tz");
+		if (!tz && window.Intl && Intl.DateTimeFormat) {
+			tz = Intl.DateTimeFormat().resolvedOptions().timeZone;
+		}
+		return tz || "";
+	};
+
 	var loadHits = function(href) {
 		var index = href.indexOf("#"),
 			what = index >= 0 ? href.substring(index + 1) : null;
@@ -19,47 +27,74 @@
 			return;
 		}
 
-		var chart = new google.visualization.LineChart($('#hitsChart').get(0));
-		$.ajax({
-			type: "GET",
-			dataType: "json",
-			url: url.replace(/\/day$/, "/" + what),
-			success: function(data) {
-				var maxValue = 0,
-					values = parseValues(data);
-				for (var i=0, limit=values.length; i < limit; i++) {
-					if (values[i][1] > 0 && values[i][1] > maxValue) {
-						maxValue = values[i][1];
-					}
+		var chart = new google.visualization.LineChart($('#hitsChart').get(0)),
+			hitsUrl = url.replace(/\/day$/, "/" + what) + "?tz=" + encodeURIComponent(timezone());
+		$.when(
+			$.ajax({ type: "GET", dataType: "json", url: hitsUrl }),
+			$.ajax({ type: "GET", dataType: "json", url: hitsUrl + "&series=uniques" }),
+			$.ajax({ type: "GET", dataType: "json", url: hitsUrl + "&series=bots" })
+		).done(function(hits, uniques, bots) {
+			var maxValue = 0,
+				values = [ ["", "Hits", "Unique visitors", "Bot hits"] ];
+			hits = hits[0];
+			uniques = uniques[0];
+			bots = bots[0];
+			for (var i=0, limit=hits.length; i < limit; i++) {
+				values.push([ hits[i].Name, hits[i].Value, uniques[i] ? uniques[i].Value : 0, bots[i] ? bots[i].Value : 0 ]);
+				if (hits[i].Value > maxValue) {
+					maxValue = hits[i].Value;
 				}
-				chart.draw(google.visualization.arrayToDataTable(values), {
-					"vAxis": {"viewWindowMode": "explicit", "viewWindow": { "min": 0 }, "format": maxValue >= 3 ? "#" : "#.#"},
-					"legend": {"position": "none"}
-				});
 			}
+			chart.draw(google.visualization.arrayToDataTable(values), {
+				"vAxis": {"viewWindowMode": "explicit", "viewWindow": { "min": 0 }, "format": maxValue >= 3 ? "#" : "#.#"},
+				"legend": {"position": "bottom"}
+			});
 		});
 	};
 
-	var loadSources = function() {
-		var url = $("#stats").attr("rel");
+	var loadSources = function(href, filters) {
+		var index = href.indexOf("#"),
+			what = index >= 0 ? href.substring(index + 1) : null,
+			url = $("#stats").attr("rel");
 		if (!url) {
 			return;
 		}
 
+		url = url.replace(/\/day$/, "/sources") + "?tz=" + encodeURIComponent(timezone());
+		if (what) {
+			url += "&period=" + encodeURIComponent(what);
+		}
+		filters = filters || {};
+		$.each(filters, function(name, value) {
+			url += "&" + name + "=" + encodeURIComponent(value);
+		});
+
 		$.ajax({
 			type: "GET",
 			dataType: "json",
-			url: url.replace(/\/day$/, "/sources"),
+			url: url,
 			success: function(data) {
-				if (!data.Browsers || !data.Countries || !data.OS || !data.Referrers) {
+				if (data.error) {
 					return;
 				}
+				$.each(["Browsers", "Countries", "Regions", "Cities", "Networks", "OS", "Referrers", "Domains", "Channels", "Devices", "Languages", "Versions", "Bots"], function(i, name) {
+					data[name] = data[name] || [];
+				});
 
 				var charts = {
 					browsers: new google.visualization.PieChart($('#browsersChart').get(0)),
 					countries: new google.visualization.GeoChart($('#countriesChart').get(0)),
+					regions: new google.visualization.ColumnChart($('#regionsChart').get(0)),
+					cities: new google.visualization.ColumnChart($('#citiesChart').get(0)),
+					networks: new google.visualization.ColumnChart($('#networksChart').get(0)),
 					os: new google.visualization.PieChart($('#osChart').get(0)),
-					referrers: new google.visualization.ColumnChart($('#referrersChart').get(0))
+					referrers: new google.visualization.ColumnChart($('#referrersChart').get(0)),
+					domains: new google.visualization.ColumnChart($('#domainsChart').get(0)),
+					channels: new google.visualization.PieChart($('#channelsChart').get(0)),
+					devices: new google.visualization.PieChart($('#devicesChart').get(0)),
+					versions: new google.visualization.ColumnChart($('#versionsChart').get(0)),
+					bots: new google.visualization.PieChart($('#botsChart').get(0)),
+					languages: new google.visualization.PieChart($('#languagesChart').get(0))
 				};
 
 				charts.browsers.draw(google.visualization.arrayToDataTable(parseValues(data.Browsers)), {
@@ -68,12 +103,63 @@
 				charts.countries.draw(google.visualization.arrayToDataTable(parseValues(data.Countries)), {
 					"colorAxis": {"colors": ['red','#004411']}
 				});
+				charts.regions.draw(google.visualization.arrayToDataTable(parseValues(data.Regions)), {
+					"title": filters.country ? "Regions of " + filters.country : "Regions",
+					"legend": {"position": "none"}
+				});
+				charts.cities.draw(google.visualization.arrayToDataTable(parseValues(data.Cities)), {
+					"title": filters.country ? "Cities of " + filters.country : "Cities",
+					"legend": {"position": "none"}
+				});
+				charts.networks.draw(google.visualization.arrayToDataTable(parseValues(data.Networks)), {
+					"title": "Networks",
+					"legend": {"position": "none"}
+				});
 				charts.os.draw(google.visualization.arrayToDataTable(parseValues(data.OS)), {
 					"legend": {"position": "bottom"}
 				});
 				charts.referrers.draw(google.visualization.arrayToDataTable(parseValues(data.Referrers)), {
+					"title": filters.domain ? "Referrers from " + filters.domain : "",
+					"legend": {"position": "none"}
+				});
+				charts.domains.draw(google.visualization.arrayToDataTable(parseValues(data.Domains)), {
+					"legend": {"position": "none"}
+				});
+				charts.channels.draw(google.visualization.arrayToDataTable(parseValues(data.Channels)), {
+					"legend": {"position": "bottom"}
+				});
+				data.Campaigns = data.Campaigns || {};
+				$.each({source: "Campaign sources", medium: "Campaign mediums", campaign: "Campaigns", term: "Campaign terms", content: "Campaign contents"}, function(parameter, title) {
+					var id = "#utm" + parameter.charAt(0).toUpperCase() + parameter.substring(1) + "Chart";
+					new google.visualization.ColumnChart($(id).get(0)).draw(google.visualization.arrayToDataTable(parseValues(data.Campaigns[parameter] || [])), {
+						"title": title,
+						"legend": {"position": "none"}
+					});
+				});
+				google.visualization.events.addListener(charts.domains, "select", function() {
+					var selection = charts.domains.getSelection();
+					if (selection.length && selection[0].row !== null) {
+						loadSources(href, $.extend({}, filters, {domain: data.Domains[selection[0].row].Name}));
+					}
+				});
+				google.visualization.events.addListener(charts.countries, "select", function() {
+					var selection = charts.countries.getSelection();
+					if (selection.length && selection[0].row !== null) {
+						loadSources(href, $.extend({}, filters, {country: data.Countries[selection[0].row].Name}));
+					}
+				});
+				charts.devices.draw(google.visualization.arrayToDataTable(parseValues(data.Devices)), {
+					"legend": {"position": "bottom"}
+				});
+				charts.versions.draw(google.visualization.arrayToDataTable(parseValues(data.Versions)), {
 					"legend": {"position": "none"}
 				});
+				charts.bots.draw(google.visualization.arrayToDataTable(parseValues(data.Bots)), {
+					"legend": {"position": "bottom"}
+				});
+				charts.languages.draw(google.visualization.arrayToDataTable(parseValues(data.Languages)), {
+					"legend": {"position": "bottom"}
+				});
 			}
 		});
 	};
@@ -84,10 +170,11 @@
 			$("#change a").click(function(e) {
 				e.preventDefault();
 				loadHits($(this).attr("href"));
+				loadSources($(this).attr("href"));
 			});
 
 			loadHits(location.href);
-			loadSources();
+			loadSources(location.href);
 		});
 	});
 })(jQuery);
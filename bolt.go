@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"strings"
+	"time"
+)
+
+var (
+	boltUrls     = []byte("urls")
+	boltCounters = []byte("counters")
+	boltMembers  = []byte("members")
+	boltDistinct = []byte("distinct")
+)
+
+// BoltStore keeps URLs and statistics in a single BoltDB file. Counters
+// without a member live in the counters bucket, keyed by dimension and key
+// under a bucket per URL, while members are stored on their own bucket per
+// dimension and key under the members bucket. Observed members are kept the
+// same way under the distinct bucket, with empty values.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltUrls, boltCounters, boltMembers, boltDistinct} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+func (this *BoltStore) Exists(id string) (exists bool, err error) {
+	err = this.db.View(func(tx *bolt.Tx) error {
+		exists = tx.Bucket(boltUrls).Get([]byte(id)) != nil
+		return nil
+	})
+	return
+}
+
+func (this *BoltStore) Load(id string) (url *Url, err error) {
+	err = this.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(boltUrls).Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		url = new(Url)
+		return json.Unmarshal(data, url)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (this *BoltStore) Save(url *Url) error {
+	data, err := json.Marshal(url)
+	if err != nil {
+		return err
+	}
+
+	return this.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltUrls).Put([]byte(url.Id), data)
+	})
+}
+
+func (this *BoltStore) Delete(id string) error {
+	return this.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltUrls).Delete([]byte(id))
+	})
+}
+
+func (this *BoltStore) Incr(counters []Counter) error {
+	return this.db.Update(func(tx *bolt.Tx) error {
+		for _, counter := range counters {
+			bucket, err := this.bucket(tx, counter, true)
+			if err != nil {
+				return err
+			}
+
+			name := this.name(counter)
+			if err := bucket.Put(name, boltEncode(boltDecode(bucket.Get(name))+1)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (this *BoltStore) Counts(counters []Counter) (totals []int, err error) {
+	totals = make([]int, len(counters))
+	err = this.db.View(func(tx *bolt.Tx) error {
+		for i, counter := range counters {
+			bucket, _ := this.bucket(tx, counter, false)
+			if bucket != nil {
+				totals[i] = boltDecode(bucket.Get(this.name(counter)))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (this *BoltStore) Members(id string, dimension string, key string) (stats Stats, err error) {
+	err = this.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltMembers).Bucket([]byte(id))
+		if bucket != nil {
+			bucket = bucket.Bucket([]byte(dimension + ":" + key))
+		}
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(member []byte, value []byte) error {
+			stats = append(stats, &Stat{Name: string(member), Value: boltDecode(value)})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (this *BoltStore) Observe(counters []Counter) error {
+	return this.db.Update(func(tx *bolt.Tx) error {
+		for _, counter := range counters {
+			bucket, err := tx.Bucket(boltDistinct).CreateBucketIfNotExists([]byte(counter.Id))
+			if err != nil {
+				return err
+			}
+			bucket, err = bucket.CreateBucketIfNotExists([]byte(counter.Dimension + ":" + counter.Key))
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(counter.Member), []byte{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (this *BoltStore) Distinct(groups [][]Counter) (totals []int, err error) {
+	totals = make([]int, len(groups))
+	err = this.db.View(func(tx *bolt.Tx) error {
+		for i, group := range groups {
+			union := make(map[string]bool)
+			for _, counter := range group {
+				bucket := tx.Bucket(boltDistinct).Bucket([]byte(counter.Id))
+				if bucket != nil {
+					bucket = bucket.Bucket([]byte(counter.Dimension + ":" + counter.Key))
+				}
+				if bucket == nil {
+					continue
+				}
+				bucket.ForEach(func(member []byte, value []byte) error {
+					union[string(member)] = true
+					return nil
+				})
+			}
+			totals[i] = len(union)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (this *BoltStore) Compact(retention Retention) error {
+	return this.db.Update(func(tx *bolt.Tx) error {
+		// Counters without a member are values named after dimension and key,
+		// everything else a bucket named that way
+		for _, name := range [][]byte{boltCounters, boltMembers, boltDistinct} {
+			err := tx.Bucket(name).ForEach(func(id []byte, value []byte) error {
+				bucket := tx.Bucket(name).Bucket(id)
+				if bucket == nil {
+					return nil
+				}
+
+				var expired [][]byte
+				bucket.ForEach(func(name []byte, value []byte) error {
+					if retention.ExpiredKey(boltCounterKey(name)) {
+						expired = append(expired, name)
+					}
+					return nil
+				})
+
+				for _, name := range expired {
+					var err error
+					if bucket.Bucket(name) != nil {
+						err = bucket.DeleteBucket(name)
+					} else {
+						err = bucket.Delete(name)
+					}
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (this *BoltStore) Close() error {
+	return this.db.Close()
+}
+
+// bucket returns the bucket holding the given counter, creating it if asked
+// to. When not creating, a nil bucket means the counter was never set.
+func (this *BoltStore) bucket(tx *bolt.Tx, counter Counter, create bool) (*bolt.Bucket, error) {
+	path := [][]byte{boltCounters, []byte(counter.Id)}
+	if !counter.Plain() {
+		path = [][]byte{boltMembers, []byte(counter.Id), []byte(counter.Dimension + ":" + counter.Key)}
+	}
+
+	bucket := tx.Bucket(path[0])
+	for _, name := range path[1:] {
+		if !create {
+			bucket = bucket.Bucket(name)
+			if bucket == nil {
+				return nil, nil
+			}
+			continue
+		}
+
+		var err error
+		bucket, err = bucket.CreateBucketIfNotExists(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return bucket, nil
+}
+
+// name returns the key a counter value is stored under within its bucket.
+func (this *BoltStore) name(counter Counter) []byte {
+	if !counter.Plain() {
+		return []byte(counter.Member)
+	}
+	return []byte(counter.Dimension + ":" + counter.Key)
+}
+
+func boltEncode(value int) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, uint64(value))
+	return data
+}
+
+func boltDecode(data []byte) int {
+	if len(data) != 8 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint64(data))
+}
+
+// boltCounterKey returns the counter key out of a dimension and key name.
+func boltCounterKey(name []byte) string {
+	key := string(name)
+	if i := strings.Index(key, ":"); i != -1 {
+		return key[i+1:]
+	}
+	return key
+}
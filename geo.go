@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"github.com/nranchev/go-libGeoIP"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Location is where a client address is from. Fields the database doesn't
+// provide are left empty.
+type Location struct {
+	Country string
+	Region  string
+	City    string
+	Network string
+}
+
+// GeoProvider locates client addresses on a geolocation database.
+type GeoProvider interface {
+	// Locate returns where the given address is from, nil if unknown.
+	Locate(ip net.IP) (*Location, error)
+
+	// Built returns when the database was built, zero if unknown.
+	Built() time.Time
+
+	Close() error
+}
+
+// NewGeoProvider opens a geolocation database, telling MaxMind DB files
+// apart from legacy ones by their extension. The IPv6 database is only used
+// along with legacy IPv4 databases, as MaxMind DB files hold both. If an ASN
+// database is given, networks are looked up on it as well.
+func NewGeoProvider(path string, pathV6 string, pathAsn string) (provider GeoProvider, err error) {
+	if strings.HasSuffix(strings.ToLower(path), ".mmdb") {
+		provider, err = NewMmdbGeoProvider(path)
+	} else {
+		provider, err = NewLegacyGeoProvider(path, pathV6)
+	}
+	if err != nil || pathAsn == "" {
+		return
+	}
+
+	asn, err := NewMmdbAsnProvider(provider, pathAsn)
+	if err != nil {
+		provider.Close()
+		return nil, err
+	}
+	return asn, nil
+}
+
+// LegacyGeoProvider reads MaxMind's legacy country databases, with a
+// database for IPv4 addresses and an optional one for IPv6 addresses.
+type LegacyGeoProvider struct {
+	gi  *libgeo.GeoIP
+	gi6 *GeoIPv6
+}
+
+func NewLegacyGeoProvider(path string, pathV6 string) (provider *LegacyGeoProvider, err error) {
+	provider = &LegacyGeoProvider{}
+	provider.gi, err = libgeo.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	if pathV6 != "" {
+		provider.gi6, err = LoadGeoIPv6(pathV6)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return provider, nil
+}
+
+func (this *LegacyGeoProvider) Locate(ip net.IP) (*Location, error) {
+	if v4 := ip.To4(); v4 != nil {
+		location := this.gi.GetLocationByIP(v4.String())
+		if location == nil {
+			return nil, nil
+		}
+		return &Location{Country: location.CountryCode}, nil
+	} else if this.gi6 != nil {
+		if country := this.gi6.Country(ip); country != "" {
+			return &Location{Country: country}, nil
+		}
+	}
+	return nil, nil
+}
+
+// Built returns zero, as the legacy reader doesn't expose the database
+// build date.
+func (this *LegacyGeoProvider) Built() time.Time {
+	return time.Time{}
+}
+
+func (this *LegacyGeoProvider) Close() error {
+	return nil
+}
+
+// LoadGeo opens the geolocation databases at the given paths, as taken by
+// NewGeoProvider, logging when they were built.
+func LoadGeo(paths []string) (GeoProvider, error) {
+	provider, err := NewGeoProvider(paths[0], paths[1], paths[2])
+	if err != nil {
+		return nil, err
+	}
+
+	if built := provider.Built(); built.IsZero() {
+		log.Println(fmt.Sprintf("Loaded geolocation database %s, build date unknown", paths[0]))
+	} else {
+		log.Println(fmt.Sprintf("Loaded geolocation database %s, built on %s", paths[0], built.UTC().Format(time.RFC1123)))
+	}
+	return provider, nil
+}
+
+// GeoReloader loads the geolocation databases at the given paths again,
+// swapping them into the request parser, whenever a SIGHUP is received or,
+// checking every given interval unless 0, any of their files changes. The
+// databases in use are kept if loading fails.
+func GeoReloader(parser *RequestParser, paths []string, interval time.Duration) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	var ticks <-chan time.Time
+	if interval > 0 {
+		ticks = time.Tick(interval)
+	}
+
+	loaded := geoModified(paths)
+	for {
+		select {
+		case <-hangups:
+		case <-ticks:
+			if geoModified(paths) == loaded {
+				continue
+			}
+		}
+
+		modified := geoModified(paths)
+		provider, err := LoadGeo(paths)
+		if err != nil {
+			log.Println(fmt.Sprintf("Could not reload geolocation database: %s", err))
+			continue
+		}
+		if err := parser.SwapGeo(provider); err != nil {
+			log.Println(fmt.Sprintf("Could not close previous geolocation database: %s", err))
+		}
+		loaded = modified
+	}
+}
+
+// geoModified returns the modification times of the given files, joined in
+// a single string so they are easily compared.
+func geoModified(paths []string) (modified string) {
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			modified += path + "@" + info.ModTime().String() + ";"
+		}
+	}
+	return modified
+}
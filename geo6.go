@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+)
+
+const (
+	geoCountryV6Edition = 12
+	geoCountryBegin     = 16776960
+	geoRecordLength     = 3
+)
+
+// geoCountryCodes are the countries on legacy MaxMind databases, by index.
+var geoCountryCodes = []string{
+	"", "AP", "EU", "AD", "AE", "AF", "AG", "AI", "AL", "AM", "CW",
+	"AO", "AQ", "AR", "AS", "AT", "AU", "AW", "AZ", "BA", "BB",
+	"BD", "BE", "BF", "BG", "BH", "BI", "BJ", "BM", "BN", "BO",
+	"BR", "BS", "BT", "BV", "BW", "BY", "BZ", "CA", "CC", "CD",
+	"CF", "CG", "CH", "CI", "CK", "CL", "CM", "CN", "CO", "CR",
+	"CU", "CV", "CX", "CY", "CZ", "DE", "DJ", "DK", "DM", "DO",
+	"DZ", "EC", "EE", "EG", "EH", "ER", "ES", "ET", "FI", "FJ",
+	"FK", "FM", "FO", "FR", "SX", "GA", "GB", "GD", "GE", "GF",
+	"GH", "GI", "GL", "GM", "GN", "GP", "GQ", "GR", "GS", "GT",
+	"GU", "GW", "GY", "HK", "HM", "HN", "HR", "HT", "HU", "ID",
+	"IE", "IL", "IN", "IO", "IQ", "IR", "IS", "IT", "JM", "JO",
+	"JP", "KE", "KG", "KH", "KI", "KM", "KN", "KP", "KR", "KW",
+	"KY", "KZ", "LA", "LB", "LC", "LI", "LK", "LR", "LS", "LT",
+	"LU", "LV", "LY", "MA", "MC", "MD", "MG", "MH", "MK", "ML",
+	"MM", "MN", "MO", "MP", "MQ", "MR", "MS", "MT", "MU", "MV",
+	"MW", "MX", "MY", "MZ", "NA", "NC", "NE", "NF", "NG", "NI",
+	"NL", "NO", "NP", "NR", "NU", "NZ", "OM", "PA", "PE", "PF",
+	"PG", "PH", "PK", "PL", "PM", "PN", "PR", "PS", "PT", "PW",
+	"PY", "QA", "RE", "RO", "RU", "RW", "SA", "SB", "SC", "SD",
+	"SE", "SG", "SH", "SI", "SJ", "SK", "SL", "SM", "SN", "SO",
+	"SR", "ST", "SV", "SY", "SZ", "TC", "TD", "TF", "TG", "TH",
+	"TJ", "TK", "TM", "TN", "TO", "TL", "TR", "TT", "TV", "TW",
+	"TZ", "UA", "UG", "UM", "US", "UY", "UZ", "VA", "VC", "VE",
+	"VG", "VI", "VN", "VU", "WF", "WS", "YE", "YT", "RS", "ZA",
+	"ZM", "ME", "ZW", "A1", "A2", "O1", "AX", "GG", "IM", "JE",
+	"BL", "MF", "BQ", "SS", "O1",
+}
+
+// GeoIPv6 reads MaxMind's legacy IPv6 country database, which the legacy
+// reader used for IPv4 addresses doesn't support.
+type GeoIPv6 struct {
+	data []byte
+}
+
+func LoadGeoIPv6(path string) (*GeoIPv6, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// The edition is stored after three 0xFF bytes near the end of the file
+	edition := -1
+	for i := len(data) - 3; i >= 0 && i >= len(data)-23; i-- {
+		if data[i] == 0xFF && data[i+1] == 0xFF && data[i+2] == 0xFF && i+3 < len(data) {
+			edition = int(data[i+3])
+			if edition >= 106 {
+				edition -= 105
+			}
+			break
+		}
+	}
+	if edition != geoCountryV6Edition {
+		return nil, errors.New(fmt.Sprintf("%s is not an IPv6 country database", path))
+	}
+
+	return &GeoIPv6{data: data}, nil
+}
+
+// Country returns the country code of the given IPv6 address, empty if
+// unknown.
+func (this *GeoIPv6) Country(ip net.IP) string {
+	ip = ip.To16()
+	if ip == nil {
+		return ""
+	}
+
+	offset := 0
+	for depth := 127; depth >= 0; depth-- {
+		position := 2 * geoRecordLength * offset
+		if ip[15-depth/8]&(1<<uint(depth%8)) != 0 {
+			position += geoRecordLength
+		}
+		if position+geoRecordLength > len(this.data) {
+			return ""
+		}
+
+		record := int(this.data[position]) | int(this.data[position+1])<<8 | int(this.data[position+2])<<16
+		if record >= geoCountryBegin {
+			index := record - geoCountryBegin
+			if index < len(geoCountryCodes) {
+				return geoCountryCodes[index]
+			}
+			return ""
+		}
+		offset = record
+	}
+	return ""
+}
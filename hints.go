@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// clientHintBrands maps the brands sent on client hints to the browser names
+// reported by the user agent parser.
+var clientHintBrands = map[string]string{
+	"Google Chrome":    "Chrome",
+	"Microsoft Edge":   "Edge",
+	"Brave":            "Brave",
+	"Opera":            "Opera",
+	"Vivaldi":          "Vivaldi",
+	"Samsung Internet": "Samsung Internet",
+	"YaBrowser":        "Yandex Browser",
+}
+
+// ClientHints are the browser details sent on the Sec-CH-UA headers.
+type ClientHints struct {
+	Browser  string
+	Version  string
+	Platform string
+	Mobile   bool
+}
+
+// clientHints returns the client hints sent on the request, nil if there are
+// none.
+func clientHints(req *http.Request) *ClientHints {
+	brands := req.Header.Get("Sec-Ch-Ua")
+	if brands == "" {
+		return nil
+	}
+
+	hints := &ClientHints{
+		Platform: strings.Trim(req.Header.Get("Sec-Ch-Ua-Platform"), "\""),
+		Mobile:   req.Header.Get("Sec-Ch-Ua-Mobile") == "?1",
+	}
+	if list := req.Header.Get("Sec-Ch-Ua-Full-Version-List"); list != "" {
+		brands = list
+	}
+
+	// Chromium is only taken when no better known brand comes along
+	for _, brand := range strings.Split(brands, ",") {
+		name, version := clientHintBrand(brand)
+		if name == "" || strings.Contains(name, "Not") && strings.Contains(name, "Brand") {
+			continue
+		}
+
+		if known, exists := clientHintBrands[name]; exists {
+			hints.Browser, hints.Version = known, version
+			break
+		} else if name == "Chromium" {
+			hints.Browser, hints.Version = name, version
+		}
+	}
+
+	return hints
+}
+
+// clientHintBrand splits a brand on a Sec-CH-UA header, such as
+// "Google Chrome";v="118", into its name and version.
+func clientHintBrand(brand string) (name string, version string) {
+	for i, part := range strings.Split(brand, ";") {
+		part = strings.TrimSpace(part)
+		if i == 0 {
+			name = strings.Trim(part, "\"")
+		} else if strings.HasPrefix(part, "v=") {
+			version = strings.Trim(part[2:], "\"")
+		}
+	}
+	return name, version
+}
+
+type languageWeight struct {
+	language string
+	weight   float64
+}
+
+// preferredLanguage returns the primary language subtag, such as "en", of
+// the language weighted the highest on an Accept-Language header.
+func preferredLanguage(header string) string {
+	var languages []languageWeight
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		tag := strings.TrimSpace(fields[0])
+		if tag == "" || tag == "*" {
+			continue
+		}
+
+		weight := 1.0
+		for _, field := range fields[1:] {
+			field = strings.TrimSpace(field)
+			if strings.HasPrefix(field, "q=") {
+				if q, err := strconv.ParseFloat(field[2:], 64); err == nil {
+					weight = q
+				}
+			}
+		}
+		if weight <= 0 {
+			continue
+		}
+
+		if i := strings.Index(tag, "-"); i != -1 {
+			tag = tag[:i]
+		}
+		languages = append(languages, languageWeight{strings.ToLower(tag), weight})
+	}
+
+	if len(languages) == 0 {
+		return ""
+	}
+	sort.Stable(byWeight(languages))
+	return languages[0].language
+}
+
+type byWeight []languageWeight
+
+func (this byWeight) Len() int           { return len(this) }
+func (this byWeight) Swap(i, j int)      { this[i], this[j] = this[j], this[i] }
+func (this byWeight) Less(i, j int) bool { return this[i].weight > this[j].weight }
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/gob"
+	"os"
+	"sync"
+)
+
+// MemoryStore keeps everything in process, optionally persisting a snapshot
+// to disk when closed so it can be loaded back on the next start.
+type MemoryStore struct {
+	sync.RWMutex
+	urls     map[string]*Url
+	counters map[Counter]map[string]int
+	distinct map[Counter]map[string]bool
+	snapshot string
+}
+
+type memorySnapshot struct {
+	Urls     map[string]*Url
+	Counters map[Counter]map[string]int
+	Distinct map[Counter]map[string]bool
+}
+
+func NewMemoryStore(snapshot string) (*MemoryStore, error) {
+	store := &MemoryStore{
+		urls:     make(map[string]*Url),
+		counters: make(map[Counter]map[string]int),
+		distinct: make(map[Counter]map[string]bool),
+		snapshot: snapshot,
+	}
+
+	if snapshot == "" {
+		return store, nil
+	}
+
+	file, err := os.Open(snapshot)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var data memorySnapshot
+	if err := gob.NewDecoder(file).Decode(&data); err != nil {
+		return nil, err
+	}
+	if data.Urls != nil {
+		store.urls = data.Urls
+	}
+	if data.Counters != nil {
+		store.counters = data.Counters
+	}
+	if data.Distinct != nil {
+		store.distinct = data.Distinct
+	}
+
+	return store, nil
+}
+
+func (this *MemoryStore) Exists(id string) (bool, error) {
+	this.RLock()
+	defer this.RUnlock()
+
+	_, exists := this.urls[id]
+	return exists, nil
+}
+
+func (this *MemoryStore) Load(id string) (*Url, error) {
+	this.RLock()
+	defer this.RUnlock()
+
+	url, exists := this.urls[id]
+	if !exists {
+		return nil, nil
+	}
+
+	copy := *url
+	return &copy, nil
+}
+
+func (this *MemoryStore) Save(url *Url) error {
+	this.Lock()
+	defer this.Unlock()
+
+	copy := *url
+	this.urls[url.Id] = &copy
+	return nil
+}
+
+func (this *MemoryStore) Delete(id string) error {
+	this.Lock()
+	defer this.Unlock()
+
+	delete(this.urls, id)
+	return nil
+}
+
+func (this *MemoryStore) Incr(counters []Counter) error {
+	this.Lock()
+	defer this.Unlock()
+
+	for _, counter := range counters {
+		key, member := this.split(counter)
+		members, exists := this.counters[key]
+		if !exists {
+			members = make(map[string]int)
+			this.counters[key] = members
+		}
+		members[member]++
+	}
+
+	return nil
+}
+
+func (this *MemoryStore) Counts(counters []Counter) ([]int, error) {
+	this.RLock()
+	defer this.RUnlock()
+
+	totals := make([]int, len(counters))
+	for i, counter := range counters {
+		key, member := this.split(counter)
+		totals[i] = this.counters[key][member]
+	}
+
+	return totals, nil
+}
+
+func (this *MemoryStore) Members(id string, dimension string, key string) (Stats, error) {
+	this.RLock()
+	defer this.RUnlock()
+
+	members := this.counters[Counter{Id: id, Dimension: dimension, Key: key}]
+	if len(members) == 0 {
+		return nil, nil
+	}
+
+	stats := make(Stats, 0, len(members))
+	for member, total := range members {
+		stats = append(stats, &Stat{Name: member, Value: total})
+	}
+
+	return stats, nil
+}
+
+func (this *MemoryStore) Observe(counters []Counter) error {
+	this.Lock()
+	defer this.Unlock()
+
+	for _, counter := range counters {
+		key, member := this.split(counter)
+		members, exists := this.distinct[key]
+		if !exists {
+			members = make(map[string]bool)
+			this.distinct[key] = members
+		}
+		members[member] = true
+	}
+
+	return nil
+}
+
+func (this *MemoryStore) Distinct(groups [][]Counter) ([]int, error) {
+	this.RLock()
+	defer this.RUnlock()
+
+	totals := make([]int, len(groups))
+	for i, group := range groups {
+		if len(group) == 1 {
+			key, _ := this.split(group[0])
+			totals[i] = len(this.distinct[key])
+			continue
+		}
+
+		union := make(map[string]bool)
+		for _, counter := range group {
+			key, _ := this.split(counter)
+			for member := range this.distinct[key] {
+				union[member] = true
+			}
+		}
+		totals[i] = len(union)
+	}
+
+	return totals, nil
+}
+
+func (this *MemoryStore) Compact(retention Retention) error {
+	this.Lock()
+	defer this.Unlock()
+
+	for key := range this.counters {
+		if retention.ExpiredKey(key.Key) {
+			delete(this.counters, key)
+		}
+	}
+
+	for key := range this.distinct {
+		if retention.ExpiredKey(key.Key) {
+			delete(this.distinct, key)
+		}
+	}
+
+	return nil
+}
+
+// Close writes the snapshot file, if one was configured.
+func (this *MemoryStore) Close() error {
+	if this.snapshot == "" {
+		return nil
+	}
+
+	this.RLock()
+	defer this.RUnlock()
+
+	file, err := os.Create(this.snapshot + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	err = gob.NewEncoder(file).Encode(memorySnapshot{Urls: this.urls, Counters: this.counters, Distinct: this.distinct})
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	return os.Rename(file.Name(), this.snapshot)
+}
+
+// split separates the member from a counter, leaving the key its members
+// are grouped under.
+func (this *MemoryStore) split(counter Counter) (Counter, string) {
+	member := counter.Member
+	counter.Member = ""
+	return counter, member
+}
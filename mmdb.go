@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"github.com/oschwald/maxminddb-golang"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// mmdbRecord holds the fields read from country and city databases, both
+// sharing the same layout for countries.
+type mmdbRecord struct {
+	Country struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+	Subdivisions []struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+}
+
+// mmdbAsnRecord holds the fields read from ASN databases.
+type mmdbAsnRecord struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+// MmdbGeoProvider reads MaxMind DB files, such as the GeoIP2 and GeoLite2
+// country and city databases.
+type MmdbGeoProvider struct {
+	reader *maxminddb.Reader
+}
+
+func NewMmdbGeoProvider(path string) (*MmdbGeoProvider, error) {
+	reader, err := openMmdb(path)
+	if err != nil {
+		return nil, err
+	}
+	return &MmdbGeoProvider{reader: reader}, nil
+}
+
+// openMmdb reads a whole MaxMind DB file into memory rather than mapping
+// it, so writing over the file while it is being used can't crash lookups.
+func openMmdb(path string) (*maxminddb.Reader, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return maxminddb.FromBytes(data)
+}
+
+func (this *MmdbGeoProvider) Locate(ip net.IP) (*Location, error) {
+	var record mmdbRecord
+	if err := this.reader.Lookup(ip, &record); err != nil {
+		return nil, err
+	}
+
+	location := &Location{Country: record.Country.IsoCode, City: record.City.Names["en"]}
+	if location.Country == "" {
+		location.Country = record.RegisteredCountry.IsoCode
+	}
+	if len(record.Subdivisions) > 0 {
+		location.Region = record.Subdivisions[0].Names["en"]
+	}
+	if location.Country == "" {
+		return nil, nil
+	}
+	return location, nil
+}
+
+func (this *MmdbGeoProvider) Built() time.Time {
+	return time.Unix(int64(this.reader.Metadata.BuildEpoch), 0)
+}
+
+func (this *MmdbGeoProvider) Close() error {
+	return this.reader.Close()
+}
+
+// MmdbAsnProvider adds the network a client address belongs to, looked up
+// on a MaxMind ASN database, to the location given by another provider.
+type MmdbAsnProvider struct {
+	GeoProvider
+	reader *maxminddb.Reader
+}
+
+func NewMmdbAsnProvider(provider GeoProvider, path string) (*MmdbAsnProvider, error) {
+	reader, err := openMmdb(path)
+	if err != nil {
+		return nil, err
+	}
+	return &MmdbAsnProvider{GeoProvider: provider, reader: reader}, nil
+}
+
+func (this *MmdbAsnProvider) Locate(ip net.IP) (*Location, error) {
+	location, err := this.GeoProvider.Locate(ip)
+	if err != nil {
+		return nil, err
+	}
+
+	var record mmdbAsnRecord
+	if err := this.reader.Lookup(ip, &record); err != nil {
+		return nil, err
+	} else if record.Number == 0 {
+		return location, nil
+	}
+
+	if location == nil {
+		location = &Location{}
+	}
+	location.Network = fmt.Sprintf("AS%d %s", record.Number, record.Organization)
+	return location, nil
+}
+
+func (this *MmdbAsnProvider) Close() error {
+	err := this.reader.Close()
+	if closeErr := this.GeoProvider.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
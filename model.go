@@ -2,32 +2,46 @@ package main
 
 import (
 	"crypto/rand"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/garyburd/redigo/redis"
 	"math"
 	"net/url"
 	"regexp"
 	"sort"
-	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 const (
 	alphanum = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	keyt     = "total"
 	keyy     = "year:%d"
 	keym     = "month:%0d-%0.2d"
 	keyd     = "day:%d-%0.2d-%0.2d"
 	keyh     = "hour:%d-%0.2d-%0.2d %0.2d"
 	keyi     = "minute:%d-%0.2d-%0.2d %0.2d:%0.2d"
+
+	// maxMemberLength is the most bytes a member is stored with
+	maxMemberLength = 255
 )
 
 type Url struct {
 	Id          string
 	Destination string
 	Created     time.Time
+	RedirectOptions
+}
+
+// RedirectOptions tell how the query string of the destination is built on
+// every redirect. Parameters is a query string merged into the destination,
+// while Passthrough forwards the query string given on the short URL.
+// Precedence tells which one wins when both have the same parameter, either
+// "link" or "request".
+type RedirectOptions struct {
+	Parameters  string
+	Passthrough bool
+	Precedence  string
 }
 
 type Stat struct {
@@ -37,42 +51,159 @@ type Stat struct {
 
 type SourceStats struct {
 	Countries Stats
+	Regions   Stats
+	Cities    Stats
+	Networks  Stats
 	Browsers  Stats
 	OS        Stats
 	Referrers Stats
+	Domains   Stats
+	Channels  Stats
+	Campaigns map[string]Stats
+	Devices   Stats
+	Languages Stats
+	Versions  Stats
+	Bots      Stats
 }
 
 type Stats []*Stat
 type Descending Stats
-type Format func(string) (string, error)
 
-var pool *redis.Pool;
+// Dimension is a statistic recorded on every hit. Plain dimensions are a
+// single counter, while the rest count hits under each of their members.
+// Member returns the value the hit is counted under, ignored for plain
+// dimensions and never empty otherwise, and whether the hit should be
+// recorded on this dimension at all. Bots tells whether the dimension is
+// still recorded for bots when they are counted separately.
+type Dimension struct {
+	Name   string
+	Plain  bool
+	Bots   bool
+	Member func(r *Request) (string, bool)
+}
 
-func init() {
-	pool = &redis.Pool{
-		MaxIdle: 5,
-		IdleTimeout: 240 * time.Second,
-		Dial: func () (redis.Conn, error) {
-			c, err := redis.Dial("tcp", settings.RedisUrl)
-			if err != nil {
-				return nil, err
+// plainDimensions tells which dimensions are plain counters, for stores to
+// keep them apart from the ones with members.
+var plainDimensions = map[string]bool{}
+
+var (
+	store      Store
+	dimensions = []Dimension{
+		{Name: "hits", Plain: true, Member: func(r *Request) (string, bool) {
+			return "", true
+		}},
+		{Name: "countries", Member: func(r *Request) (string, bool) {
+			return r.Country, r.Country != ""
+		}},
+		{Name: "regions", Member: func(r *Request) (string, bool) {
+			return r.Country + "/" + r.Region, r.Country != "" && r.Region != ""
+		}},
+		{Name: "cities", Member: func(r *Request) (string, bool) {
+			// Cities with no known region, such as city states, go right under
+			// their country
+			parent := r.Country
+			if r.Region != "" {
+				parent += "/" + r.Region
 			}
-			return c, nil
-		},
-		TestOnBorrow: func(c redis.Conn, t time.Time) error {
-			_, err := c.Do("PING")
-			return err
-		},
+			return parent + "/" + r.City, r.Country != "" && r.City != ""
+		}},
+		{Name: "networks", Member: func(r *Request) (string, bool) {
+			return r.Network, r.Network != ""
+		}},
+		{Name: "browsers", Member: func(r *Request) (string, bool) {
+			return unknown(r.Browser), !r.Bot
+		}},
+		{Name: "os", Member: func(r *Request) (string, bool) {
+			return unknown(r.OS), !r.Bot
+		}},
+		{Name: "referrers", Member: func(r *Request) (string, bool) {
+			return r.Referrer, true
+		}},
+		{Name: "domains", Member: func(r *Request) (string, bool) {
+			return r.Domain, r.Domain != ""
+		}},
+		{Name: "channels", Member: func(r *Request) (string, bool) {
+			return r.Channel, r.Channel != ""
+		}},
+		{Name: "devices", Bots: true, Member: func(r *Request) (string, bool) {
+			return r.Device, r.Device != ""
+		}},
+		{Name: "languages", Member: func(r *Request) (string, bool) {
+			return r.Language, r.Language != ""
+		}},
+		{Name: "versions", Member: func(r *Request) (string, bool) {
+			return r.MajorVersion(), !r.Bot && r.Browser != ""
+		}},
+		{Name: "bots", Bots: true, Member: func(r *Request) (string, bool) {
+			return r.BotName, r.Bot
+		}},
+		{Name: "bothits", Plain: true, Bots: true, Member: func(r *Request) (string, bool) {
+			return "", r.Bot
+		}},
+	}
+)
+
+func init() {
+	for _, parameter := range utmParameters {
+		dimensions = append(dimensions, utmDimension(parameter))
+	}
+	for _, dimension := range dimensions {
+		plainDimensions[dimension.Name] = dimension.Plain
 	}
 }
 
-func NewUrl(data string) (entity *Url, err error) {
+// unknown names values the client didn't give away.
+func unknown(value string) string {
+	if value == "" {
+		return "Unknown"
+	}
+	return value
+}
+
+// truncateMember cuts a member down to maxMemberLength bytes, on a
+// character boundary, so long referrers and the like fit every store.
+func truncateMember(member string) string {
+	if len(member) <= maxMemberLength {
+		return member
+	}
+
+	i := maxMemberLength
+	for i > 0 && !utf8.RuneStart(member[i]) {
+		i--
+	}
+	return member[:i]
+}
+
+// utmDimension records hits under the value of a campaign parameter.
+func utmDimension(parameter string) Dimension {
+	return Dimension{Name: "utm_" + parameter, Member: func(r *Request) (string, bool) {
+		value := r.Utm[parameter]
+		return value, value != ""
+	}}
+}
+
+func NewUrl(data string, options RedirectOptions) (entity *Url, err error) {
 	data = strings.TrimSpace(data)
 	if len(data) == 0 {
 		err = errors.New("Please specify an URL")
 		return
 	}
 
+	options.Parameters = strings.TrimPrefix(strings.TrimSpace(options.Parameters), "?")
+	if _, err = url.ParseQuery(options.Parameters); err != nil {
+		err = errors.New(fmt.Sprintf("Invalid query parameters: %s", options.Parameters))
+		return
+	}
+
+	switch options.Precedence {
+	case "":
+		options.Precedence = "link"
+	case "link", "request":
+	default:
+		err = errors.New(fmt.Sprintf("Invalid precedence: %s", options.Precedence))
+		return
+	}
+
 	if matches, _ := regexp.MatchString("^https?", data); !matches {
 		data = "http://" + data
 	}
@@ -90,10 +221,7 @@ func NewUrl(data string) (entity *Url, err error) {
 		return
 	}
 
-	entity = &Url{Destination: u.String(), Created: time.Now()}
-
-	c := pool.Get()
-	defer c.Close()
+	entity = &Url{Destination: u.String(), Created: time.Now(), RedirectOptions: options}
 
 	bytes := make([]byte, settings.UrlLength)
 	for {
@@ -102,376 +230,422 @@ func NewUrl(data string) (entity *Url, err error) {
 			bytes[i] = alphanum[b%byte(len(alphanum))]
 		}
 		id := string(bytes)
-		if exists, _ := redis.Bool(c.Do("EXISTS", settings.RedisPrefix+"url:"+id)); !exists {
-			entity.Id = id
-			break
-		}
-
-		if exists, _ := GetUrl(id); exists == nil {
+		exists, err := store.Exists(id)
+		if err != nil {
+			return nil, err
+		} else if !exists {
 			entity.Id = id
 			break
 		}
 	}
 
-	entity.Save()
+	if err = entity.Save(); err != nil {
+		return nil, err
+	}
 
 	return entity, nil
 }
 
 func GetUrl(id string) (*Url, error) {
-	c := pool.Get()
-	defer c.Close()
+	return store.Load(id)
+}
 
-	reply, err := c.Do("GET", settings.RedisPrefix+"url:"+id)
-	if reply == nil {
-		return nil, nil
+func (this *Url) Save() error {
+	return store.Save(this)
+}
+
+func (this *Url) Delete() error {
+	return store.Delete(this.Id)
+}
+
+// Target returns where to redirect to, merging the link parameters and, if
+// passing them through, the ones given on the short URL.
+func (this *Url) Target(query url.Values) string {
+	if this.Parameters == "" && (!this.Passthrough || len(query) == 0) {
+		return this.Destination
 	}
 
-	data, err := redis.Bytes(reply, err)
+	destination, err := url.Parse(this.Destination)
 	if err != nil {
-		return nil, err
+		return this.Destination
 	}
 
-	var url Url
-	if err := json.Unmarshal(data, &url); err != nil {
-		return nil, err
+	parameters, _ := url.ParseQuery(this.Parameters)
+	layers := []url.Values{parameters}
+	if this.Passthrough {
+		if this.Precedence == "request" {
+			layers = append(layers, query)
+		} else {
+			layers = append([]url.Values{query}, layers...)
+		}
 	}
 
-	return &url, nil
+	merged := destination.Query()
+	for _, layer := range layers {
+		for name, values := range layer {
+			merged[name] = values
+		}
+	}
+	destination.RawQuery = merged.Encode()
+	return destination.String()
 }
 
-func (this *Url) Save() error {
-	c := pool.Get()
-	defer c.Close()
-
-	data, err := json.Marshal(this)
+func (this *Url) Hits() (total int, err error) {
+	totals, err := store.Counts([]Counter{{Id: this.Id, Dimension: "hits", Key: keyt}})
 	if err != nil {
-		return err
+		return 0, err
 	}
+	return totals[0], nil
+}
 
-	reply, err := c.Do("SET", settings.RedisPrefix+"url:"+this.Id, data)
-	if err == nil && reply != "OK" {
-		err = errors.New("Invalid Redis response")
+// Visitors returns the approximate number of unique visitors.
+func (this *Url) Visitors() (int, error) {
+	totals, err := store.Distinct([][]Counter{{{Id: this.Id, Dimension: "uniques", Key: keyt}}})
+	if err != nil {
+		return 0, err
 	}
+	return totals[0], nil
+}
+
+func (this *Url) Countries(window *Bucket, sorting bool) (Stats, error) {
+	return this.keyStats("countries", window, sorting)
+}
+
+// Regions returns the hits on each region, named after their country as in
+// "AR/Buenos Aires".
+func (this *Url) Regions(window *Bucket, sorting bool) (Stats, error) {
+	return this.keyStats("regions", window, sorting)
+}
+
+// Cities returns the hits on each city, named after their country and
+// region as in "AR/Buenos Aires/La Plata", or just their country as in
+// "SG/Singapore" when the region is unknown.
+func (this *Url) Cities(window *Bucket, sorting bool) (Stats, error) {
+	return this.keyStats("cities", window, sorting)
+}
+
+// CountryRegions returns the hits on each region of the given country.
+func (this *Url) CountryRegions(country string, window *Bucket, sorting bool) (Stats, error) {
+	return this.within("regions", country, window, sorting)
+}
+
+// CountryCities returns the hits on each city of the given country.
+func (this *Url) CountryCities(country string, window *Bucket, sorting bool) (Stats, error) {
+	return this.within("cities", country, window, sorting)
+}
+
+func (this *Url) Networks(window *Bucket, sorting bool) (Stats, error) {
+	return this.keyStats("networks", window, sorting)
+}
+
+func (this *Url) Browsers(window *Bucket, sorting bool) (Stats, error) {
+	return this.keyStats("browsers", window, sorting)
+}
 
+func (this *Url) OS(window *Bucket, sorting bool) (Stats, error) {
+	return this.keyStats("os", window, sorting)
+}
+
+func (this *Url) Referrers(window *Bucket, sorting bool) (Stats, error) {
+	return this.keyStats("referrers", window, sorting)
+}
+
+// DomainReferrers returns the referrers belonging to the given registrable
+// domain.
+func (this *Url) DomainReferrers(domain string, window *Bucket, sorting bool) (Stats, error) {
+	referrers, err := this.Referrers(window, sorting)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	var stats Stats
+	for _, referrer := range referrers {
+		if referrerDomain(referrer.Name) == domain {
+			stats = append(stats, referrer)
+		}
+	}
+	return stats, nil
 }
 
-func (this *Url) Delete() error {
-	c := pool.Get()
-	defer c.Close()
-
-	reply, err := c.Do("DEL", settings.RedisPrefix+"url:"+this.Id)
-	if err == nil && reply != "OK" {
-		return errors.New("Invalid Redis response")
-	}
-
-	return nil
-}
-
-func (this *Url) Hit(r *Request) (err error) {
-	c := pool.Get()
-	defer c.Close()
-
-	now := time.Now()
-	year, month, day := now.Date()
-	hour := now.Hour()
-	minute := 5 * int(math.Abs(float64(now.Minute()/5)))
-	prefix := settings.RedisPrefix + "stats:" + this.Id + ":"
-	hitsPrefix := prefix + "hits:"
-	countriesPrefix := prefix + "countries:"
-	browsersPrefix := prefix + "browsers:"
-	osPrefix := prefix + "os:"
-	referrerPrefix := prefix + "referrers:"
-
-	c.Send("INCR", hitsPrefix+"total")
-	c.Send("INCR", fmt.Sprintf(hitsPrefix+keyy, year))
-	c.Send("INCR", fmt.Sprintf(hitsPrefix+keym, year, month))
-	c.Send("INCR", fmt.Sprintf(hitsPrefix+keyd, year, month, day))
-	c.Send("INCR", fmt.Sprintf(hitsPrefix+keyh, year, month, day, hour))
-	c.Send("INCR", fmt.Sprintf(hitsPrefix+keyi, year, month, day, hour, minute))
-
-	if r.Country != "" {
-		c.Send("INCR", countriesPrefix+"total:"+r.Country)
-		c.Send("INCR", fmt.Sprintf(countriesPrefix+keyy+":"+r.Country, year))
-		c.Send("INCR", fmt.Sprintf(countriesPrefix+keym+":"+r.Country, year, month))
-		c.Send("INCR", fmt.Sprintf(countriesPrefix+keyd+":"+r.Country, year, month, day))
-		c.Send("INCR", fmt.Sprintf(countriesPrefix+keyh+":"+r.Country, year, month, day, hour))
-		c.Send("INCR", fmt.Sprintf(countriesPrefix+keyi+":"+r.Country, year, month, day, hour, minute))
-	}
-
-	if !r.Bot {
-		c.Send("INCR", browsersPrefix+"total:"+r.Browser)
-		c.Send("INCR", fmt.Sprintf(browsersPrefix+keyy+":"+r.Browser, year))
-		c.Send("INCR", fmt.Sprintf(browsersPrefix+keym+":"+r.Browser, year, month))
-		c.Send("INCR", fmt.Sprintf(browsersPrefix+keyd+":"+r.Browser, year, month, day))
-		c.Send("INCR", fmt.Sprintf(browsersPrefix+keyh+":"+r.Browser, year, month, day, hour))
-		c.Send("INCR", fmt.Sprintf(browsersPrefix+keyi+":"+r.Browser, year, month, day, hour, minute))
-
-		c.Send("INCR", osPrefix+"total:"+r.OS)
-		c.Send("INCR", fmt.Sprintf(osPrefix+keyy+":"+r.OS, year))
-		c.Send("INCR", fmt.Sprintf(osPrefix+keym+":"+r.OS, year, month))
-		c.Send("INCR", fmt.Sprintf(osPrefix+keyd+":"+r.OS, year, month, day))
-		c.Send("INCR", fmt.Sprintf(osPrefix+keyh+":"+r.OS, year, month, day, hour))
-		c.Send("INCR", fmt.Sprintf(osPrefix+keyi+":"+r.OS, year, month, day, hour, minute))
-	}
-
-	c.Send("INCR", referrerPrefix+"total:"+r.Referrer)
-	c.Send("INCR", fmt.Sprintf(referrerPrefix+keyy+":"+r.Referrer, year))
-	c.Send("INCR", fmt.Sprintf(referrerPrefix+keym+":"+r.Referrer, year, month))
-	c.Send("INCR", fmt.Sprintf(referrerPrefix+keyd+":"+r.Referrer, year, month, day))
-	c.Send("INCR", fmt.Sprintf(referrerPrefix+keyh+":"+r.Referrer, year, month, day, hour))
-	c.Send("INCR", fmt.Sprintf(referrerPrefix+keyi+":"+r.Referrer, year, month, day, hour, minute))
-
-	c.Flush()
-	return
+func (this *Url) Domains(window *Bucket, sorting bool) (Stats, error) {
+	return this.keyStats("domains", window, sorting)
 }
 
-func (this *Url) Hits() (total int, err error) {
-	c := pool.Get()
-	defer c.Close()
+func (this *Url) Channels(window *Bucket, sorting bool) (Stats, error) {
+	return this.keyStats("channels", window, sorting)
+}
 
-	prefix := settings.RedisPrefix + "stats:" + this.Id + ":hits:"
-	result, err := c.Do("GET", prefix+"total")
-	if result == nil {
-		return 0, nil
-	}
-	return redis.Int(result, err)
+// Campaign returns the hits on each value of a campaign parameter, given
+// without its utm_ prefix.
+func (this *Url) Campaign(parameter string, window *Bucket, sorting bool) (Stats, error) {
+	return this.keyStats("utm_"+parameter, window, sorting)
 }
 
-func (this *Url) Countries(sorting bool) (Stats, error) {
-	return this.keyStats(settings.RedisPrefix+"stats:"+this.Id+":countries:total:*", sorting)
+func (this *Url) Devices(window *Bucket, sorting bool) (Stats, error) {
+	return this.keyStats("devices", window, sorting)
 }
 
-func (this *Url) Browsers(sorting bool) (Stats, error) {
-	return this.keyStats(settings.RedisPrefix+"stats:"+this.Id+":browsers:total:*", sorting)
+func (this *Url) Languages(window *Bucket, sorting bool) (Stats, error) {
+	return this.keyStats("languages", window, sorting)
 }
 
-func (this *Url) OS(sorting bool) (Stats, error) {
-	return this.keyStats(settings.RedisPrefix+"stats:"+this.Id+":os:total:*", sorting)
+func (this *Url) Versions(window *Bucket, sorting bool) (Stats, error) {
+	return this.keyStats("versions", window, sorting)
 }
 
-func (this *Url) Referrers(sorting bool) (Stats, error) {
-	return this.keyStats(settings.RedisPrefix+"stats:"+this.Id+":referrers:total:*", sorting)
+func (this *Url) Bots(window *Bucket, sorting bool) (Stats, error) {
+	return this.keyStats("bots", window, sorting)
 }
 
-func (this *Url) Sources(sorting bool) (stats SourceStats, err error) {
-	stats.Browsers, err = this.Browsers(sorting)
+// Sources returns where hits came from during the given span of time, or
+// through all time if no window is given.
+func (this *Url) Sources(window *Bucket, sorting bool) (stats SourceStats, err error) {
+	stats.Browsers, err = this.Browsers(window, sorting)
 	if err != nil {
 		return
 	}
 
-	stats.Countries, err = this.Countries(sorting)
+	stats.Countries, err = this.Countries(window, sorting)
 	if err != nil {
 		return
 	}
 
-	stats.OS, err = this.OS(sorting)
+	stats.Regions, err = this.Regions(window, sorting)
 	if err != nil {
 		return
 	}
 
-	stats.Referrers, err = this.Referrers(sorting)
+	stats.Cities, err = this.Cities(window, sorting)
 	if err != nil {
 		return
 	}
 
-	return
-}
+	stats.Networks, err = this.Networks(window, sorting)
+	if err != nil {
+		return
+	}
 
-func (this *Url) Stats(past string) (stats Stats, err error) {
-	c := pool.Get()
-	defer c.Close()
-
-	now := time.Now()
-	year, month, day := now.Date()
-	prefix := settings.RedisPrefix + "stats:" + this.Id + ":hits:"
-
-	var (
-		separator string
-		search    string
-		moment    int
-		start     int
-		limit     int
-		increment int
-	)
-
-	start = 1
-	increment = 1
-	format := func(value string) (string, error) {
-		return value, nil
-	}
-	switch {
-	case past == "hour":
-		search = prefix + keyi
-		separator = " %d:"
-		moment = now.Hour()
-		search = fmt.Sprintf(search[0:strings.LastIndex(search, ":")]+":*", year, month, day, moment)
-		start = 0
-		limit = 60
-		increment = 5
-		format = func(value string) (string, error) {
-			return fmt.Sprintf("%0.2d:%s", moment, value), nil
-		}
-	case past == "day":
-		search = prefix + keyh
-		separator = "-%d"
-		moment = day
-		search = fmt.Sprintf(search[0:strings.LastIndex(search, " ")]+" *", year, month, moment)
-		limit = 24
-		format = func(value string) (string, error) {
-			return fmt.Sprintf("%s:00", value), nil
-		}
-	case past == "week":
-		search = prefix + keyd
-		separator = "%d-"
-		moment = int(month)
-		search = fmt.Sprintf(search[0:strings.LastIndex(search, "-%0.2d")]+"-*", year, moment)
-		if int(now.Weekday()) == 0 {
-			start = day - 6
-		} else {
-			start = day - (int(now.Weekday()) - 1)
-		}
-		limit = start + 7
-		format = func(value string) (string, error) {
-			date := fmt.Sprintf("%d-%0.2d-%s", year, month, value)
-			time, err := time.Parse("2006-01-02", date)
-			if err != nil {
-				return "", err
-			}
-			return fmt.Sprintf("%s %s", time.Weekday().String(), value), nil
-		}
-	case past == "month":
-		search = prefix + keyd
-		separator = "%d-"
-		moment = int(month)
-		search = fmt.Sprintf(search[0:strings.LastIndex(search, "-%0.2d")]+"-*", year, moment)
-		limit = time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
-		format = func(value string) (string, error) {
-			date := fmt.Sprintf("%d-%0.2d-%s", year, month, value)
-			time, err := time.Parse("2006-01-02", date)
-			if err != nil {
-				return "", err
-			}
-			month, _ := strconv.ParseInt(value, 10, 32)
-			return fmt.Sprintf("%s %d", time.Month().String(), month), nil
-		}
-	case past == "year":
-		search = prefix + keym
-		separator = "%d-"
-		moment = year
-		search = fmt.Sprintf(search[0:strings.LastIndex(search, "-%0.2d")]+"-*", moment)
-		limit = 12
-		format = func(value string) (string, error) {
-			date := fmt.Sprintf("%d-%s-01", year, value)
-			time, err := time.Parse("2006-01-02", date)
-			if err != nil {
-				return "", err
-			}
-			return fmt.Sprintf("%s %d", time.Month().String(), year), nil
+	stats.OS, err = this.OS(window, sorting)
+	if err != nil {
+		return
+	}
+
+	stats.Referrers, err = this.Referrers(window, sorting)
+	if err != nil {
+		return
+	}
+
+	stats.Domains, err = this.Domains(window, sorting)
+	if err != nil {
+		return
+	}
+
+	stats.Channels, err = this.Channels(window, sorting)
+	if err != nil {
+		return
+	}
+
+	stats.Campaigns = make(map[string]Stats)
+	for _, parameter := range utmParameters {
+		stats.Campaigns[parameter], err = this.Campaign(parameter, window, sorting)
+		if err != nil {
+			return
 		}
-	case past == "all":
-		search = prefix + keyy
-		separator = ":"
-		search = search[0:strings.LastIndex(search, "%d")] + "*"
-		start = now.Year() - 10
-		limit = int(now.Year()) + 1
-	default:
-		return nil, errors.New(fmt.Sprintf("Invalid stat requested: %s", past))
 	}
 
-	stats, err = getStats(c, search, separator, moment, start, limit, increment, format)
+	stats.Devices, err = this.Devices(window, sorting)
 	if err != nil {
-		return nil, err
+		return
 	}
 
-	return stats, nil
+	stats.Languages, err = this.Languages(window, sorting)
+	if err != nil {
+		return
+	}
+
+	stats.Versions, err = this.Versions(window, sorting)
+	if err != nil {
+		return
+	}
+
+	stats.Bots, err = this.Bots(window, sorting)
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+// Stats returns the hits on each of the given buckets.
+func (this *Url) Stats(buckets []Bucket) (Stats, error) {
+	return this.series("hits", buckets)
 }
 
-func (this *Url) keyStats(search string, sorting bool) (stats Stats, err error) {
-	c := pool.Get()
-	defer c.Close()
+// BotHits returns the hits by bots on each of the given buckets.
+func (this *Url) BotHits(buckets []Bucket) (Stats, error) {
+	return this.series("bothits", buckets)
+}
+
+// series sums the counters of a dimension on each of the given buckets.
+func (this *Url) series(dimension string, buckets []Bucket) (Stats, error) {
+	groups := this.groups(dimension, buckets)
 
-	values, err := redis.Values(c.Do("KEYS", search))
+	var counters []Counter
+	for _, group := range groups {
+		counters = append(counters, group...)
+	}
+
+	totals, err := store.Counts(counters)
 	if err != nil {
 		return nil, err
-	} else if len(values) == 0 {
-		return nil, nil
 	}
 
-	keys := make([]interface{}, len(values))
+	stats := make(Stats, len(buckets))
 	i := 0
-	for _, value := range values {
-		key, err := redis.String(value, nil)
-		if err == nil {
-			keys[i] = key
+	for j, group := range groups {
+		stats[j] = &Stat{Name: buckets[j].Name}
+		for _ = range group {
+			stats[j].Value += totals[i]
 			i++
 		}
 	}
+	return stats, nil
+}
 
-	values, err = redis.Values(c.Do("MGET", keys...))
+// Uniques returns the approximate unique visitors on each of the given
+// buckets.
+func (this *Url) Uniques(buckets []Bucket) (Stats, error) {
+	totals, err := store.Distinct(this.groups("uniques", buckets))
 	if err != nil {
 		return nil, err
 	}
 
-	stats = make(Stats, len(values))
+	stats := make(Stats, len(buckets))
+	for i, total := range totals {
+		stats[i] = &Stat{Name: buckets[i].Name, Value: total}
+	}
+	return stats, nil
+}
 
-	for i, value := range values {
-		key := keys[i].(string)
-		total, err := redis.Int(value, nil)
-		if err == nil {
-			stats[i] = &Stat{Name: key[strings.LastIndex(key, ":")+1:], Value: total}
-		}
+// hitCounters returns every counter to increment for a hit at the given
+// moment, following the policy on bot traffic.
+func (this *Url) hitCounters(r *Request, moment time.Time) []Counter {
+	if r.Bot && settings.BotPolicy == "ignore" {
+		return nil
 	}
 
-	if sorting {
-		sort.Sort(stats)
+	var counters []Counter
+	for _, dimension := range dimensions {
+		if r.Bot && settings.BotPolicy == "separate" && !dimension.Bots {
+			continue
+		}
+		// Requests opting out of tracking are only counted as a hit
+		if r.OptOut && dimension.Name != "hits" && dimension.Name != "bothits" {
+			continue
+		}
+		member, record := dimension.Member(r)
+		if dimension.Plain {
+			member = ""
+		} else if member == "" {
+			record = false
+		} else {
+			member = truncateMember(member)
+		}
+		if record {
+			counters = append(counters, this.counters(dimension.Name, member, moment)...)
+		}
 	}
+	return counters
+}
 
-	return stats, nil
+// visitorCounters returns the unique visitor sets a hit at the given moment
+// belongs to.
+func (this *Url) visitorCounters(r *Request, moment time.Time) []Counter {
+	if r.Visitor == "" || r.OptOut || (r.Bot && settings.BotPolicy != "count") {
+		return nil
+	}
+	return this.counters("uniques", r.Visitor, moment)
 }
 
-func getStats(c redis.Conn, search string, separator string, moment int, start int, limit int, increment int, format Format) (Stats, error) {
-	length := int(math.Ceil(float64((limit - start) / increment)))
-	stats := make(Stats, length)
+// counters returns the total and per period counters to increment for a hit
+// on the given dimension at the given moment. Periods are always in UTC.
+func (this *Url) counters(dimension string, member string, moment time.Time) []Counter {
+	moment = moment.UTC()
+	year, month, day := moment.Date()
+	hour := moment.Hour()
+	minute := 5 * int(math.Abs(float64(moment.Minute()/5)))
 
-	redisKeys := make([]interface{}, length)
-	j := 0
+	keys := []string{
+		keyt,
+		fmt.Sprintf(keyy, year),
+		fmt.Sprintf(keym, year, month),
+		fmt.Sprintf(keyd, year, month, day),
+		fmt.Sprintf(keyh, year, month, day, hour),
+		fmt.Sprintf(keyi, year, month, day, hour, minute),
+	}
 
-	prefix := search[:strings.LastIndex(search, "*")]
-	for i := start; i < limit; i += increment {
-		key := fmt.Sprintf("%0.2d", i)
-		name, err := format(key)
-		if err != nil {
-			name = key
-		}
+	counters := make([]Counter, len(keys))
+	for i, key := range keys {
+		counters[i] = Counter{Id: this.Id, Dimension: dimension, Key: key, Member: member}
+	}
+	return counters
+}
 
-		redisKeys[j] = prefix + key
-		stats[j] = &Stat{
-			Name:  name,
-			Value: 0,
+// groups returns, for each bucket, the counters of a dimension covering it.
+func (this *Url) groups(dimension string, buckets []Bucket) [][]Counter {
+	groups := make([][]Counter, len(buckets))
+	for i, bucket := range buckets {
+		for _, key := range bucket.Keys() {
+			groups[i] = append(groups[i], Counter{Id: this.Id, Dimension: dimension, Key: key})
 		}
-		j++
 	}
+	return groups
+}
 
-	values, err := redis.Values(c.Do("MGET", redisKeys...))
+// within returns the members of a dimension nested under the given parent,
+// such as the regions of a country.
+func (this *Url) within(dimension string, parent string, window *Bucket, sorting bool) (Stats, error) {
+	members, err := this.keyStats(dimension, window, sorting)
 	if err != nil {
-		return stats, err
+		return nil, err
 	}
 
-	if strings.Index(separator, "%d") >= 0 {
-		separator = fmt.Sprintf(separator, moment)
+	var stats Stats
+	for _, member := range members {
+		if strings.HasPrefix(member.Name, parent+"/") {
+			stats = append(stats, member)
+		}
 	}
+	return stats, nil
+}
 
-	for i, value := range values {
-		total, err := redis.Int(value, nil)
-		if err == nil {
-			stats[i].Value = total
+func (this *Url) keyStats(dimension string, window *Bucket, sorting bool) (stats Stats, err error) {
+	if window == nil {
+		stats, err = store.Members(this.Id, dimension, keyt)
+		if err != nil {
+			return nil, err
 		}
+	} else {
+		totals := make(map[string]*Stat)
+		for _, key := range window.Keys() {
+			members, err := store.Members(this.Id, dimension, key)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, member := range members {
+				if stat, exists := totals[member.Name]; exists {
+					stat.Value += member.Value
+				} else {
+					totals[member.Name] = member
+					stats = append(stats, member)
+				}
+			}
+		}
+	}
+
+	if sorting {
+		sort.Sort(stats)
 	}
 
 	return stats, nil
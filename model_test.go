@@ -0,0 +1,107 @@
+package main
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testStores returns a store of each kind, along with a function releasing
+// them all.
+func testStores(t *testing.T) (map[string]Store, func()) {
+	dir, err := ioutil.TempDir("", "stores")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stores := map[string]Store{"redis": NewRedisStore(server.Addr(), "test:")}
+	if stores["memory"], err = NewMemoryStore(""); err != nil {
+		t.Fatal(err)
+	}
+	if stores["bolt"], err = NewBoltStore(filepath.Join(dir, "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	if stores["sql"], err = NewSqlStore("sqlite3", ":memory:"); err != nil {
+		t.Fatal(err)
+	}
+
+	return stores, func() {
+		for _, store := range stores {
+			store.Close()
+		}
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestUniquesPastRetention(t *testing.T) {
+	stores, release := testStores(t)
+	defer release()
+
+	previous, retention := store, settings.Retention
+	defer func() { store, settings.Retention = previous, retention }()
+	settings.Retention = Retention{"minute": 48 * time.Hour, "hour": 90 * 24 * time.Hour}
+
+	now := time.Now().UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	old := now.Add(-10 * 24 * time.Hour).Truncate(time.Hour)
+	buckets := []Bucket{
+		{Name: "old minutes", From: old, To: old.Add(5 * time.Minute)},
+		{Name: "today", From: today, To: today.AddDate(0, 0, 1)},
+		{Name: "old hour", From: old.Add(-100 * 24 * time.Hour), To: old.Add(-100*24*time.Hour + time.Hour)},
+	}
+
+	for name, s := range stores {
+		store = s
+		url := &Url{Id: "abc"}
+		if err := store.Observe(url.visitorCounters(&Request{Visitor: "visitor"}, now)); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		stats, err := url.Uniques(buckets)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+
+		for i, expected := range []int{0, 1, 0} {
+			if stats[i].Value != expected {
+				t.Errorf("%s: %s has %d visitors, expected %d", name, stats[i].Name, stats[i].Value, expected)
+			}
+		}
+	}
+}
+
+func TestCityMembers(t *testing.T) {
+	var cities Dimension
+	for _, dimension := range dimensions {
+		if dimension.Name == "cities" {
+			cities = dimension
+		}
+	}
+
+	tests := []struct {
+		request  Request
+		expected string
+		record   bool
+	}{
+		{Request{Country: "AR", Region: "Buenos Aires", City: "La Plata"}, "AR/Buenos Aires/La Plata", true},
+		{Request{Country: "SG", City: "Singapore"}, "SG/Singapore", true},
+		{Request{Country: "AR", Region: "Buenos Aires"}, "", false},
+		{Request{City: "Nowhere"}, "", false},
+	}
+
+	for _, test := range tests {
+		member, record := cities.Member(&test.request)
+		if record != test.record || (record && member != test.expected) {
+			t.Errorf("Got %q (%v) for %+v, expected %q (%v)", member, record, test.request, test.expected, test.record)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxRangeSteps = 2000
+
+// periodLayouts are the time layouts of the buckets on counter keys for the
+// periods that may expire.
+var periodLayouts = map[string]string{
+	"minute": "2006-01-02 15:04",
+	"hour":   "2006-01-02 15",
+	"day":    "2006-01-02",
+}
+
+// Retention tells for how long counters of each period are kept, periods
+// missing or set to 0 being kept forever.
+type Retention map[string]time.Duration
+
+// Bucket is a span of time shown as a single stat, such as an hour or a day
+// on the time zone of whoever is looking at the statistics. Hits are
+// counted on UTC periods, so a bucket is made up of every stored period
+// needed to cover it.
+type Bucket struct {
+	Name string
+	From time.Time
+	To   time.Time
+}
+
+// PeriodBuckets splits the current hour, day, week, month or year, or the
+// last ten years for "all", into buckets on the given location. Rolling
+// periods such as "24hours" end with the bucket holding the current moment
+// instead, reaching as far back as needed.
+func PeriodBuckets(past string, location *time.Location) ([]Bucket, error) {
+	return periodBuckets(past, time.Now().In(location))
+}
+
+// periodBuckets splits the period of the given name around a moment into
+// buckets on the moment's location.
+func periodBuckets(past string, now time.Time) (buckets []Bucket, err error) {
+	location := now.Location()
+	year, month, day := now.Date()
+
+	switch past {
+	case "hour":
+		start := time.Date(year, month, day, now.Hour(), 0, 0, 0, location)
+		for i := 0; i < 60; i += 5 {
+			from := start.Add(time.Duration(i) * time.Minute)
+			buckets = append(buckets, Bucket{Name: from.Format("15:04"), From: from, To: from.Add(5 * time.Minute)})
+		}
+	case "day":
+		// Stepping an hour at a time keeps days changing to or from daylight
+		// saving time at 23 or 25 buckets, none of them overlapping
+		start := time.Date(year, month, day, 0, 0, 0, 0, location)
+		for from, end := start, start.AddDate(0, 0, 1); from.Before(end); from = from.Add(time.Hour) {
+			buckets = append(buckets, Bucket{Name: from.Format("15:00"), From: from, To: from.Add(time.Hour)})
+		}
+	case "week":
+		offset := int(now.Weekday()) - 1
+		if offset < 0 {
+			offset = 6
+		}
+		start := time.Date(year, month, day-offset, 0, 0, 0, 0, location)
+		for i := 0; i < 7; i++ {
+			from := start.AddDate(0, 0, i)
+			buckets = append(buckets, Bucket{Name: fmt.Sprintf("%s %0.2d", from.Weekday().String(), from.Day()), From: from, To: from.AddDate(0, 0, 1)})
+		}
+	case "month":
+		start := time.Date(year, month, 1, 0, 0, 0, 0, location)
+		for from := start; from.Month() == month; from = from.AddDate(0, 0, 1) {
+			buckets = append(buckets, Bucket{Name: fmt.Sprintf("%s %d", month.String(), from.Day()), From: from, To: from.AddDate(0, 0, 1)})
+		}
+	case "year":
+		for i := 1; i <= 12; i++ {
+			from := time.Date(year, time.Month(i), 1, 0, 0, 0, 0, location)
+			buckets = append(buckets, Bucket{Name: fmt.Sprintf("%s %d", from.Month().String(), year), From: from, To: from.AddDate(0, 1, 0)})
+		}
+	case "all":
+		for i := year - 10; i <= year; i++ {
+			from := time.Date(i, 1, 1, 0, 0, 0, 0, location)
+			buckets = append(buckets, Bucket{Name: strconv.Itoa(i), From: from, To: from.AddDate(1, 0, 0)})
+		}
+	case "60minutes":
+		end := time.Date(year, month, day, now.Hour(), now.Minute()-now.Minute()%5, 0, 0, location)
+		for i := 11; i >= 0; i-- {
+			from := end.Add(time.Duration(-5*i) * time.Minute)
+			buckets = append(buckets, Bucket{Name: from.Format("15:04"), From: from, To: from.Add(5 * time.Minute)})
+		}
+	case "24hours":
+		end := time.Date(year, month, day, now.Hour(), 0, 0, 0, location)
+		for i := 23; i >= 0; i-- {
+			from := end.Add(time.Duration(-i) * time.Hour)
+			buckets = append(buckets, Bucket{Name: from.Format("Mon 15:00"), From: from, To: from.Add(time.Hour)})
+		}
+	case "7days", "30days":
+		days := 7
+		if past == "30days" {
+			days = 30
+		}
+		for i := days - 1; i >= 0; i-- {
+			from := time.Date(year, month, day-i, 0, 0, 0, 0, location)
+			buckets = append(buckets, Bucket{Name: fmt.Sprintf("%s %d", from.Month().String(), from.Day()), From: from, To: from.AddDate(0, 0, 1)})
+		}
+	case "12months":
+		for i := 11; i >= 0; i-- {
+			from := time.Date(year, month-time.Month(i), 1, 0, 0, 0, 0, location)
+			buckets = append(buckets, Bucket{Name: fmt.Sprintf("%s %d", from.Month().String(), from.Year()), From: from, To: from.AddDate(0, 1, 0)})
+		}
+	default:
+		return nil, errors.New(fmt.Sprintf("Invalid stat requested: %s", past))
+	}
+
+	return buckets, nil
+}
+
+// RangeBuckets splits the time from one moment to another into buckets of
+// the given granularity on the given location. The first and last buckets
+// are widened to start and end on a granularity boundary.
+func RangeBuckets(from time.Time, to time.Time, granularity string, location *time.Location) (buckets []Bucket, err error) {
+	from, to = from.In(location), to.In(location)
+	if to.Before(from) {
+		return nil, errors.New("The end of the range can't be before its start")
+	}
+
+	year, month, day := from.Date()
+	var (
+		moment time.Time
+		next   func(time.Time) time.Time
+		layout string
+	)
+
+	switch granularity {
+	case "5min":
+		moment = time.Date(year, month, day, from.Hour(), from.Minute()-from.Minute()%5, 0, 0, location)
+		next = func(t time.Time) time.Time { return t.Add(5 * time.Minute) }
+		layout = "2006-01-02 15:04"
+	case "hour":
+		moment = time.Date(year, month, day, from.Hour(), 0, 0, 0, location)
+		next = func(t time.Time) time.Time { return t.Add(time.Hour) }
+		layout = "2006-01-02 15:00"
+	case "day":
+		moment = time.Date(year, month, day, 0, 0, 0, 0, location)
+		next = func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }
+		layout = "2006-01-02"
+	case "month":
+		moment = time.Date(year, month, 1, 0, 0, 0, 0, location)
+		next = func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }
+		layout = "January 2006"
+	case "year":
+		moment = time.Date(year, 1, 1, 0, 0, 0, 0, location)
+		next = func(t time.Time) time.Time { return t.AddDate(1, 0, 0) }
+		layout = "2006"
+	default:
+		return nil, errors.New(fmt.Sprintf("Invalid granularity requested: %s", granularity))
+	}
+
+	for ; !moment.After(to); moment = next(moment) {
+		if len(buckets) == maxRangeSteps {
+			return nil, errors.New(fmt.Sprintf("Ranges can't have more than %d steps", maxRangeSteps))
+		}
+		buckets = append(buckets, Bucket{Name: moment.Format(layout), From: moment, To: next(moment)})
+	}
+
+	return buckets, nil
+}
+
+// Keys returns the counter keys covering the bucket, using the coarsest UTC
+// periods that fit in it. Edges falling on periods already dropped by the
+// retention policy are moved to the closest boundary of the finest period
+// still kept, so neighbouring buckets never count the same period twice. A
+// bucket too short to be told apart on the periods kept has no keys.
+func (this Bucket) Keys() (keys []string) {
+	from, unit := retainedEdge(this.From)
+	to, toUnit := retainedEdge(this.To)
+	if toUnit > unit {
+		unit = toUnit
+	}
+	if this.To.Sub(this.From) < unit/2 {
+		return nil
+	}
+
+	from = from.Truncate(5 * time.Minute)
+	for from.Before(to) {
+		year, month, day := from.Date()
+		hour, minute := from.Hour(), from.Minute()
+		midnight := hour == 0 && minute == 0
+
+		var period string
+		switch {
+		case midnight && month == time.January && day == 1 && !from.AddDate(1, 0, 0).After(to):
+			keys = append(keys, fmt.Sprintf(keyy, year))
+			from = from.AddDate(1, 0, 0)
+		case midnight && day == 1 && !from.AddDate(0, 1, 0).After(to):
+			keys = append(keys, fmt.Sprintf(keym, year, month))
+			from = from.AddDate(0, 1, 0)
+		case midnight && !from.AddDate(0, 0, 1).After(to):
+			period = "day"
+			keys = append(keys, fmt.Sprintf(keyd, year, month, day))
+			from = from.AddDate(0, 0, 1)
+		case minute == 0 && !from.Add(time.Hour).After(to):
+			period = "hour"
+			keys = append(keys, fmt.Sprintf(keyh, year, month, day, hour))
+			from = from.Add(time.Hour)
+		default:
+			period = "minute"
+			keys = append(keys, fmt.Sprintf(keyi, year, month, day, hour, minute))
+			from = from.Add(5 * time.Minute)
+		}
+
+		if period != "" && settings.Retention.Expired(period, time.Date(year, month, day, hour, minute, 0, 0, time.UTC)) {
+			return nil
+		}
+	}
+	return keys
+}
+
+// retainedEdge moves a bucket edge to the closest boundary of the finest
+// period kept for it, and returns the length of that period. Periods are
+// looked up from the start of the next coarser one, so every period between
+// there and the edge is kept too, and an edge is moved the same way for the
+// bucket ending on it and the one starting on it.
+func retainedEdge(moment time.Time) (time.Time, time.Duration) {
+	moment = moment.UTC()
+	year, month, day := moment.Date()
+	startOfHour := time.Date(year, month, day, moment.Hour(), 0, 0, 0, time.UTC)
+	startOfDay := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	startOfMonth := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+
+	var floor, ceil time.Time
+	switch {
+	case !settings.Retention.Expired("minute", startOfHour):
+		return moment, 5 * time.Minute
+	case !settings.Retention.Expired("hour", startOfDay):
+		floor, ceil = startOfHour, startOfHour.Add(time.Hour)
+	case !settings.Retention.Expired("day", startOfMonth):
+		floor, ceil = startOfDay, startOfDay.AddDate(0, 0, 1)
+	default:
+		floor, ceil = startOfMonth, startOfMonth.AddDate(0, 1, 0)
+	}
+
+	if moment.Sub(floor) <= ceil.Sub(moment) {
+		return floor, ceil.Sub(floor)
+	}
+	return ceil, ceil.Sub(floor)
+}
+
+// Expired tells whether counters of the given period, for the bucket that
+// starts at the given moment, are past retention.
+func (this Retention) Expired(period string, moment time.Time) bool {
+	duration := this[period]
+	return duration > 0 && time.Now().Sub(moment) > duration
+}
+
+// Expires returns when the counter with the given key is to be dropped, and
+// false if it is to be kept forever.
+func (this Retention) Expires(key string) (time.Time, bool) {
+	period, bucket := splitKey(key)
+	layout, exists := periodLayouts[period]
+	if !exists || this[period] <= 0 {
+		return time.Time{}, false
+	}
+
+	moment, err := time.Parse(layout, bucket)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return moment.Add(this[period]), true
+}
+
+// ExpiredKey tells whether the counter with the given key is past retention.
+func (this Retention) ExpiredKey(key string) bool {
+	expires, expiring := this.Expires(key)
+	return expiring && time.Now().After(expires)
+}
+
+// splitKey splits a counter key such as "day:2014-01-13" into its period
+// and time bucket.
+func splitKey(key string) (period string, bucket string) {
+	i := strings.Index(key, ":")
+	if i == -1 {
+		return key, ""
+	}
+	return key[:i], key[i+1:]
+}
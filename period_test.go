@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPeriodBucketsDay(t *testing.T) {
+	location, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	tests := []struct {
+		name  string
+		now   time.Time
+		count int
+	}{
+		{"regular", time.Date(2024, 6, 1, 12, 0, 0, 0, location), 24},
+		{"spring forward", time.Date(2024, 3, 10, 12, 0, 0, 0, location), 23},
+		{"fall back", time.Date(2024, 11, 3, 12, 0, 0, 0, location), 25},
+	}
+
+	for _, test := range tests {
+		buckets, err := periodBuckets("day", test.now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(buckets) != test.count {
+			t.Errorf("%s: got %d buckets, expected %d", test.name, len(buckets), test.count)
+			continue
+		}
+
+		// Buckets must cover the whole day, one after the other
+		year, month, day := test.now.Date()
+		from := time.Date(year, month, day, 0, 0, 0, 0, location)
+		for _, bucket := range buckets {
+			if !bucket.From.Equal(from) || bucket.To.Sub(bucket.From) != time.Hour {
+				t.Errorf("%s: bucket %s spans %s to %s", test.name, bucket.Name, bucket.From, bucket.To)
+			}
+			from = bucket.To
+		}
+		if end := time.Date(year, month, day+1, 0, 0, 0, 0, location); !from.Equal(end) {
+			t.Errorf("%s: buckets end at %s, expected %s", test.name, from, end)
+		}
+	}
+}
+
+func TestBucketKeysLongWindow(t *testing.T) {
+	bucket := Bucket{From: time.Date(1800, 1, 1, 0, 0, 0, 0, time.UTC), To: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	keys := bucket.Keys()
+	if len(keys) != 224 || keys[0] != "year:1800" || keys[223] != "year:2023" {
+		t.Errorf("Got %d keys for %d years", len(keys), 224)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const hitRetries = 3
+
+var (
+	hitsQueued   = expvar.NewInt("hits_queued")
+	hitsRecorded = expvar.NewInt("hits_recorded")
+	hitsDropped  = expvar.NewInt("hits_dropped")
+	hitsFailed   = expvar.NewInt("hits_failed")
+)
+
+func init() {
+	expvar.Publish("hits_pending", expvar.Func(func() interface{} {
+		if hitQueue == nil {
+			return 0
+		}
+		return len(hitQueue.hits)
+	}))
+}
+
+// MetricsHandler writes the hit queue metrics as JSON. Unlike the handler
+// that comes with expvar, it leaves out the command line, which holds
+// secrets such as the visitor salt and database credentials.
+func MetricsHandler(resp http.ResponseWriter, req *http.Request) {
+	metrics := make(map[string]json.RawMessage)
+	expvar.Do(func(variable expvar.KeyValue) {
+		if strings.HasPrefix(variable.Key, "hits_") {
+			metrics[variable.Key] = json.RawMessage(variable.Value.String())
+		}
+	})
+
+	body, err := json.Marshal(metrics)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(body)
+}
+
+type hit struct {
+	url     *Url
+	request *Request
+	moment  time.Time
+}
+
+// HitQueue records hits in the background on a fixed pool of workers, each
+// one grouping whatever hits are waiting, up to a batch size, into a single
+// store round trip. Hits arriving while the queue is full are dropped
+// rather than slowing redirects down.
+type HitQueue struct {
+	hits    chan hit
+	batch   int
+	workers sync.WaitGroup
+	lock    sync.RWMutex
+	closed  bool
+}
+
+func NewHitQueue(workers int, size int, batch int) *HitQueue {
+	if workers < 1 {
+		workers = 1
+	}
+	if batch < 1 {
+		batch = 1
+	}
+
+	queue := &HitQueue{
+		hits:  make(chan hit, size),
+		batch: batch,
+	}
+
+	for i := 0; i < workers; i++ {
+		queue.workers.Add(1)
+		go queue.work()
+	}
+
+	return queue
+}
+
+// Push queues a hit, returning false if it had to be dropped.
+func (this *HitQueue) Push(url *Url, r *Request) bool {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	if this.closed {
+		hitsDropped.Add(1)
+		return false
+	}
+
+	select {
+	case this.hits <- hit{url: url, request: r, moment: time.Now()}:
+		hitsQueued.Add(1)
+		return true
+	default:
+		hitsDropped.Add(1)
+		return false
+	}
+}
+
+// Close stops accepting hits and waits until every queued one is recorded.
+func (this *HitQueue) Close() {
+	this.lock.Lock()
+	if !this.closed {
+		this.closed = true
+		close(this.hits)
+	}
+	this.lock.Unlock()
+
+	this.workers.Wait()
+}
+
+func (this *HitQueue) work() {
+	defer this.workers.Done()
+
+	for first := range this.hits {
+		batch := []hit{first}
+	collect:
+		for len(batch) < this.batch {
+			select {
+			case next, ok := <-this.hits:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, next)
+			default:
+				break collect
+			}
+		}
+
+		this.record(batch)
+	}
+}
+
+// record writes the counters and then the visitors of a batch of hits.
+// Hits are only taken as failed when their counters couldn't be written.
+func (this *HitQueue) record(batch []hit) {
+	failed := this.write(batch, hitRetries, store.Incr, func(hit hit) []Counter {
+		return hit.url.hitCounters(hit.request, hit.moment)
+	})
+	this.write(batch, hitRetries, store.Observe, func(hit hit) []Counter {
+		return hit.url.visitorCounters(hit.request, hit.moment)
+	})
+
+	hitsRecorded.Add(int64(len(batch) - failed))
+	hitsFailed.Add(int64(failed))
+}
+
+// write applies the counters of every hit on a batch with the given store
+// operation, trying again up to the given attempts. Stores apply a whole
+// batch or none of it, so trying again never counts a hit twice, and a
+// batch still failing is written one hit at a time so a single bad hit
+// can't take the rest down with it. Returns how many hits were not written.
+func (this *HitQueue) write(batch []hit, attempts int, operation func([]Counter) error, counters func(hit) []Counter) int {
+	var all []Counter
+	for _, hit := range batch {
+		all = append(all, counters(hit)...)
+	}
+	if len(all) == 0 {
+		return 0
+	}
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err = operation(all); err == nil {
+			return 0
+		}
+		if attempt < attempts {
+			time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+		}
+	}
+
+	if len(batch) == 1 {
+		log.Println(fmt.Sprintf("Could not record hit on %s: %s", batch[0].url.Id, err))
+		return 1
+	}
+
+	failed := 0
+	for i := range batch {
+		failed += this.write(batch[i:i+1], 1, operation, counters)
+	}
+	return failed
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHitQueuePending(t *testing.T) {
+	previous := hitQueue
+	defer func() { hitQueue = previous }()
+
+	// Every test gets a queue of its own
+	for i := 0; i < 2; i++ {
+		hitQueue = NewHitQueue(1, 10, 1)
+		hitQueue.Close()
+	}
+
+	resp := httptest.NewRecorder()
+	MetricsHandler(resp, httptest.NewRequest("GET", "/debug/vars", nil))
+
+	var metrics map[string]interface{}
+	if err := json.Unmarshal(resp.Body.Bytes(), &metrics); err != nil {
+		t.Fatal(err)
+	}
+	if pending, exists := metrics["hits_pending"]; !exists || pending != 0.0 {
+		t.Errorf("Got %v hits pending, expected 0", pending)
+	}
+	if _, exists := metrics["cmdline"]; exists {
+		t.Error("The command line must not be exposed")
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"regexp"
+	"time"
+)
+
+// redisIncr increments every counter given as a key, taking the kind of
+// counter, the member and the expiration of each one as arguments. Keys are
+// checked before writing any of them, so a batch is either counted whole or
+// not at all, and can be safely tried again.
+var redisIncr = redis.NewScript(-1, `
+for i, key in ipairs(KEYS) do
+	local kind = redis.call("TYPE", key)["ok"]
+	if kind ~= "none" and kind ~= ARGV[3 * i - 2] then
+		return redis.error_reply("WRONGTYPE " .. key .. " holds a " .. kind)
+	end
+end
+
+for i, key in ipairs(KEYS) do
+	if ARGV[3 * i - 2] == "hash" then
+		redis.call("HINCRBY", key, ARGV[3 * i - 1], 1)
+	else
+		redis.call("INCR", key)
+	end
+	if ARGV[3 * i] ~= "" then
+		redis.call("EXPIREAT", key, ARGV[3 * i])
+	end
+end
+
+return #KEYS
+`)
+
+type RedisStore struct {
+	pool   *redis.Pool
+	prefix string
+}
+
+func NewRedisStore(address string, prefix string) *RedisStore {
+	return &RedisStore{
+		prefix: prefix,
+		pool: &redis.Pool{
+			MaxIdle:     5,
+			IdleTimeout: 240 * time.Second,
+			Dial: func() (redis.Conn, error) {
+				c, err := redis.Dial("tcp", address)
+				if err != nil {
+					return nil, err
+				}
+				return c, nil
+			},
+			TestOnBorrow: func(c redis.Conn, t time.Time) error {
+				_, err := c.Do("PING")
+				return err
+			},
+		},
+	}
+}
+
+func (this *RedisStore) Exists(id string) (bool, error) {
+	c := this.pool.Get()
+	defer c.Close()
+
+	return redis.Bool(c.Do("EXISTS", this.prefix+"url:"+id))
+}
+
+func (this *RedisStore) Load(id string) (*Url, error) {
+	c := this.pool.Get()
+	defer c.Close()
+
+	reply, err := c.Do("GET", this.prefix+"url:"+id)
+	if reply == nil && err == nil {
+		return nil, nil
+	}
+
+	data, err := redis.Bytes(reply, err)
+	if err != nil {
+		return nil, err
+	}
+
+	var url Url
+	if err := json.Unmarshal(data, &url); err != nil {
+		return nil, err
+	}
+
+	return &url, nil
+}
+
+func (this *RedisStore) Save(url *Url) error {
+	c := this.pool.Get()
+	defer c.Close()
+
+	data, err := json.Marshal(url)
+	if err != nil {
+		return err
+	}
+
+	reply, err := redis.String(c.Do("SET", this.prefix+"url:"+url.Id, data))
+	if err == nil && reply != "OK" {
+		err = errors.New("Invalid Redis response")
+	}
+
+	return err
+}
+
+func (this *RedisStore) Delete(id string) error {
+	c := this.pool.Get()
+	defer c.Close()
+
+	_, err := c.Do("DEL", this.prefix+"url:"+id)
+	return err
+}
+
+func (this *RedisStore) Incr(counters []Counter) error {
+	if len(counters) == 0 {
+		return nil
+	}
+
+	c := this.pool.Get()
+	defer c.Close()
+
+	args := []interface{}{len(counters)}
+	for _, counter := range counters {
+		args = append(args, this.key(counter))
+	}
+	for _, counter := range counters {
+		kind, expiration := "hash", ""
+		if counter.Plain() {
+			kind = "string"
+		}
+		if expires, expiring := settings.Retention.Expires(counter.Key); expiring {
+			expiration = fmt.Sprintf("%d", expires.Unix())
+		}
+		args = append(args, kind, counter.Member, expiration)
+	}
+
+	_, err := redisIncr.Do(c, args...)
+	return err
+}
+
+func (this *RedisStore) Counts(counters []Counter) ([]int, error) {
+	totals := make([]int, len(counters))
+	if len(counters) == 0 {
+		return totals, nil
+	}
+
+	c := this.pool.Get()
+	defer c.Close()
+
+	for _, counter := range counters {
+		if !counter.Plain() {
+			c.Send("HGET", this.key(counter), counter.Member)
+		} else {
+			c.Send("GET", this.key(counter))
+		}
+	}
+
+	if err := c.Flush(); err != nil {
+		return nil, err
+	}
+
+	for i := range counters {
+		value, err := c.Receive()
+		if err != nil {
+			return nil, err
+		} else if value != nil {
+			totals[i], _ = redis.Int(value, nil)
+		}
+	}
+
+	return totals, nil
+}
+
+func (this *RedisStore) Members(id string, dimension string, key string) (Stats, error) {
+	c := this.pool.Get()
+	defer c.Close()
+
+	values, err := redis.Values(c.Do("HGETALL", this.key(Counter{Id: id, Dimension: dimension, Key: key})))
+	if err != nil {
+		return nil, err
+	} else if len(values) == 0 {
+		return nil, nil
+	}
+
+	stats := make(Stats, 0, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		member, err := redis.String(values[i], nil)
+		if err != nil {
+			continue
+		}
+		total, err := redis.Int(values[i+1], nil)
+		if err == nil {
+			stats = append(stats, &Stat{Name: member, Value: total})
+		}
+	}
+
+	return stats, nil
+}
+
+func (this *RedisStore) Observe(counters []Counter) error {
+	if len(counters) == 0 {
+		return nil
+	}
+
+	c := this.pool.Get()
+	defer c.Close()
+
+	c.Send("MULTI")
+	for _, counter := range counters {
+		c.Send("PFADD", this.key(counter), counter.Member)
+		this.expire(c, counter)
+	}
+
+	replies, err := redis.Values(c.Do("EXEC"))
+	if err != nil {
+		return err
+	}
+
+	for _, reply := range replies {
+		if err, failed := reply.(redis.Error); failed {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (this *RedisStore) Distinct(groups [][]Counter) ([]int, error) {
+	totals := make([]int, len(groups))
+	if len(groups) == 0 {
+		return totals, nil
+	}
+
+	c := this.pool.Get()
+	defer c.Close()
+
+	// Groups covering no key, such as buckets past retention, count nobody
+	for _, group := range groups {
+		if len(group) == 0 {
+			continue
+		}
+
+		keys := make([]interface{}, len(group))
+		for i, counter := range group {
+			keys[i] = this.key(counter)
+		}
+		c.Send("PFCOUNT", keys...)
+	}
+
+	if err := c.Flush(); err != nil {
+		return nil, err
+	}
+
+	for i, group := range groups {
+		if len(group) == 0 {
+			continue
+		}
+
+		total, err := redis.Int(c.Receive())
+		if err != nil {
+			return nil, err
+		}
+		totals[i] = total
+	}
+
+	return totals, nil
+}
+
+// Compact does nothing, as counters are given an expiration when written.
+func (this *RedisStore) Compact(retention Retention) error {
+	return nil
+}
+
+// Migrate converts the counters stored with the member as the last part of
+// their key, such as stats:<id>:countries:total:AR, into hash fields. It
+// walks the keyspace with SCAN, so it can be run against a live server.
+func (this *RedisStore) Migrate() (migrated int, err error) {
+	c := this.pool.Get()
+	defer c.Close()
+
+	pattern := regexp.MustCompile("^" + regexp.QuoteMeta(this.prefix+"stats:") +
+		`([^:]+):([^:]+):(total|year:\d+|month:\d+-\d+|day:\d+-\d+-\d+|hour:\d+-\d+-\d+ \d+|minute:\d+-\d+-\d+ \d+:\d+):(.+)$`)
+
+	cursor := 0
+	for {
+		values, err := redis.Values(c.Do("SCAN", cursor, "MATCH", this.prefix+"stats:*", "COUNT", 1000))
+		if err != nil {
+			return migrated, err
+		}
+
+		var keys []string
+		if _, err := redis.Scan(values, &cursor, &keys); err != nil {
+			return migrated, err
+		}
+
+		for _, key := range keys {
+			matches := pattern.FindStringSubmatch(key)
+			if matches == nil || matches[2] == "hits" {
+				continue
+			}
+
+			total, err := redis.Int(c.Do("GET", key))
+			if err != nil {
+				// Not a plain counter, most likely an already migrated hash
+				continue
+			}
+
+			counter := Counter{Id: matches[1], Dimension: matches[2], Key: matches[3], Member: matches[4]}
+			c.Send("MULTI")
+			c.Send("HINCRBY", this.key(counter), counter.Member, total)
+			c.Send("DEL", key)
+			if _, err := c.Do("EXEC"); err != nil {
+				return migrated, err
+			}
+			migrated++
+		}
+
+		if cursor == 0 {
+			break
+		}
+	}
+
+	return migrated, nil
+}
+
+func (this *RedisStore) Close() error {
+	return this.pool.Close()
+}
+
+// expire sends the expiration of the given counter, if it has one.
+func (this *RedisStore) expire(c redis.Conn, counter Counter) {
+	if expires, expiring := settings.Retention.Expires(counter.Key); expiring {
+		c.Send("EXPIREAT", this.key(counter), expires.Unix())
+	}
+}
+
+func (this *RedisStore) key(counter Counter) string {
+	return this.prefix + "stats:" + counter.Id + ":" + counter.Dimension + ":" + counter.Key
+}
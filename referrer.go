@@ -0,0 +1,128 @@
+package main
+
+import (
+	"golang.org/x/net/publicsuffix"
+	"net/url"
+	"strings"
+)
+
+const directReferrer = "DIRECT"
+
+// referrerChannels tells the kind of source behind well known sites, by the
+// name of their registrable domain with the public suffix left out, so all
+// of google.com, google.co.uk and so on are matched at once.
+var referrerChannels = map[string]string{
+	"google":     "search",
+	"bing":       "search",
+	"yahoo":      "search",
+	"duckduckgo": "search",
+	"baidu":      "search",
+	"yandex":     "search",
+	"ask":        "search",
+	"ecosia":     "search",
+	"facebook":   "social",
+	"fb":         "social",
+	"twitter":    "social",
+	"t":          "social",
+	"x":          "social",
+	"linkedin":   "social",
+	"lnkd":       "social",
+	"reddit":     "social",
+	"instagram":  "social",
+	"pinterest":  "social",
+	"tumblr":     "social",
+	"youtube":    "social",
+	"tiktok":     "social",
+	"mastodon":   "social",
+	"outlook":    "email",
+	"hotmail":    "email",
+	"live":       "email",
+}
+
+// normalizeReferrer lowercases the scheme and host of a referrer, and drops
+// default ports, credentials and fragments, so the same page is always
+// counted under the same name.
+func normalizeReferrer(referrer string) string {
+	referrer = strings.TrimSpace(referrer)
+	if referrer == "" {
+		return directReferrer
+	}
+
+	u, err := url.Parse(referrer)
+	if err != nil || u.Host == "" {
+		return referrer
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if (u.Scheme == "http" && strings.HasSuffix(u.Host, ":80")) || (u.Scheme == "https" && strings.HasSuffix(u.Host, ":443")) {
+		u.Host = u.Host[:strings.LastIndex(u.Host, ":")]
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	u.User = nil
+	u.Fragment = ""
+	return u.String()
+}
+
+// stripReferrerQuery drops the query string of a referrer.
+func stripReferrerQuery(referrer string) string {
+	u, err := url.Parse(referrer)
+	if err != nil || u.Host == "" {
+		return referrer
+	}
+	u.RawQuery = ""
+	u.ForceQuery = false
+	return u.String()
+}
+
+// referrerHost returns the host of a referrer, without port.
+func referrerHost(referrer string) string {
+	u, err := url.Parse(referrer)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// referrerDomain returns the registrable domain a referrer belongs to, such
+// as example.co.uk for http://www.example.co.uk/page.
+func referrerDomain(referrer string) string {
+	if referrer == directReferrer {
+		return directReferrer
+	}
+
+	host := referrerHost(referrer)
+	if host == "" {
+		return referrer
+	}
+
+	domain, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return host
+	}
+	return domain
+}
+
+// referrerChannel classifies a referrer as direct, search, social, email or
+// other traffic.
+func referrerChannel(referrer string) string {
+	if referrer == directReferrer {
+		return "direct"
+	}
+
+	host := referrerHost(referrer)
+	if strings.HasPrefix(host, "mail.") || strings.HasPrefix(host, "webmail.") {
+		return "email"
+	}
+
+	domain := referrerDomain(referrer)
+	if suffix, _ := publicsuffix.PublicSuffix(domain); suffix != "" && suffix != domain {
+		domain = strings.TrimSuffix(domain, "."+suffix)
+	}
+	if channel, exists := referrerChannels[domain]; exists {
+		return channel
+	}
+	return "other"
+}
@@ -1,83 +1,378 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"github.com/mssola/user_agent"
-	"github.com/nranchev/go-libGeoIP"
+	"io"
+	"net"
 	"net/http"
 	"strings"
+	"sync"
 )
 
+// defaultBotSignatures are user agent fragments of bots the user agent parser
+// either misses or names poorly, mostly link previews on chat apps.
+var defaultBotSignatures = []string{
+	"Slackbot",
+	"Slack-ImgProxy",
+	"Twitterbot",
+	"facebookexternalhit",
+	"Facebot",
+	"WhatsApp",
+	"TelegramBot",
+	"Discordbot",
+	"LinkedInBot",
+	"SkypeUriPreview",
+	"Pinterest",
+	"redditbot",
+	"Applebot",
+	"Embedly",
+	"HeadlessChrome",
+	"curl",
+	"Wget",
+	"python-requests",
+	"Go-http-client",
+}
+
 type RequestParser struct {
-	gi *libgeo.GeoIP
+	// geoProvider locates client addresses, and may be swapped at any time
+	// while holding geoLock.
+	geoProvider GeoProvider
+	geoLock     sync.RWMutex
+
+	// Salt is mixed into visitor fingerprints so they can't be traced back
+	// to the IP address and user agent they were built from.
+	Salt string
+
+	// BotSignatures are user agent fragments, matched regardless of case,
+	// telling bots apart on top of what the user agent parser detects.
+	BotSignatures []string
+
+	// TrustedProxies are the networks whose forwarding headers are believed.
+	TrustedProxies []*net.IPNet
+
+	// DevIp, if set, is used in place of loopback clients so geolocation can
+	// be tried out locally.
+	DevIp string
+
+	Privacy Privacy
+}
+
+// Privacy tells what is left out of requests to protect visitors' privacy.
+type Privacy struct {
+	// TruncateIp zeroes the last octet of IPv4 addresses, and all but the
+	// first 48 bits of IPv6 ones, before they are located or fingerprinted.
+	TruncateIp bool
+
+	// HonorOptOut records only the aggregate hit, with no dimensions nor
+	// unique visitor, for requests sending DNT: 1 or Sec-GPC: 1.
+	HonorOptOut bool
+
+	// StripReferrerQuery drops the query string of referrers.
+	StripReferrerQuery bool
 }
 
 type Request struct {
 	Referrer string
+	Domain   string
+	Channel  string
 	Country  string
+	Region   string
+	City     string
+	Network  string
 	Bot      bool
 	Mobile   bool
 	OS       string
 	Browser  string
 	Version  string
+	Device   string
+	Language string
+	BotName  string
+	Visitor  string
+	Utm      map[string]string
+	OptOut   bool
 }
 
-func NewRequestParser(geoDb string) (parser *RequestParser, err error) {
-	parser = &RequestParser{}
-	parser.gi, err = libgeo.Load(geoDb)
-	if err != nil {
-		return nil, err
+// utmParameters are the campaign parameters captured from the short URL,
+// without their utm_ prefix.
+var utmParameters = []string{"source", "medium", "campaign", "term", "content"}
+
+func NewRequestParser(geo GeoProvider) *RequestParser {
+	return &RequestParser{geoProvider: geo, BotSignatures: append([]string{}, defaultBotSignatures...)}
+}
+
+// SwapGeo replaces the geolocation provider, closing the previous one once
+// no request is using it anymore.
+func (this *RequestParser) SwapGeo(geo GeoProvider) error {
+	this.geoLock.Lock()
+	previous := this.geoProvider
+	this.geoProvider = geo
+	this.geoLock.Unlock()
+
+	if previous == nil {
+		return nil
 	}
-	return parser, nil
+	return previous.Close()
+}
+
+// Close closes the geolocation provider.
+func (this *RequestParser) Close() error {
+	return this.SwapGeo(nil)
 }
 
 func (this *RequestParser) Parse(req *http.Request) (r *Request, err error) {
-	r = &Request{}
-	r.Country, err = this.geo(req)
+	r = &Request{OptOut: this.Privacy.HonorOptOut && optedOut(req)}
+	if !r.OptOut {
+		var ip string
+		ip, err = this.ip(req)
+		if err == nil && this.Privacy.TruncateIp {
+			ip = truncateIp(ip)
+		}
+		if err == nil {
+			var location *Location
+			location, err = this.geo(ip)
+			if location != nil {
+				r.Country, r.Region, r.City, r.Network = location.Country, location.Region, location.City, location.Network
+			}
+			r.Visitor = this.visitor(ip, req.UserAgent())
+		}
+	}
 	ua := new(user_agent.UserAgent)
 	ua.Parse(req.UserAgent())
-	r.Referrer = req.Referer()
-	if r.Referrer == "" {
-		r.Referrer = "DIRECT"
+	r.Utm = this.utm(req)
+	r.Referrer = normalizeReferrer(req.Referer())
+	if this.Privacy.StripReferrerQuery {
+		r.Referrer = stripReferrerQuery(r.Referrer)
 	}
+	r.Domain = referrerDomain(r.Referrer)
+	r.Channel = referrerChannel(r.Referrer)
 	r.Bot = ua.Bot()
 	r.Mobile = ua.Mobile()
 	r.OS = ua.OS()
 	r.Browser, r.Version = ua.Browser()
+	// The parser names some bots after a piece of their URL, such as
+	// "https:" for Slackbot, so known signatures go first
+	if signature, matches := this.bot(req.UserAgent()); matches {
+		r.Bot = true
+		r.BotName = signature
+	} else if r.Bot {
+		r.BotName = r.Browser
+	}
+	if r.Bot && r.BotName == "" {
+		r.BotName = "Unknown"
+	}
+	if hints := clientHints(req); hints != nil && !r.Bot {
+		if hints.Browser != "" {
+			r.Browser, r.Version = hints.Browser, hints.Version
+		}
+		if hints.Platform != "" {
+			r.OS = hints.Platform
+		}
+		r.Mobile = hints.Mobile
+	}
+	r.Language = preferredLanguage(req.Header.Get("Accept-Language"))
+	r.Device = device(req.UserAgent(), r.Bot, r.Mobile)
 	return r, err
 }
 
-func (this *RequestParser) geo(req *http.Request) (string, error) {
-	ip := req.Header.Get("X-Real-Ip")
-	forwarded := req.Header.Get("X-Forwarded-For")
-	if ip == "" && forwarded == "" {
-		i := strings.LastIndex(req.RemoteAddr, ":")
-		if i != -1 {
-			ip = req.RemoteAddr[:i]
-		} else {
-			ip = req.RemoteAddr
+// utm returns the campaign parameters given on the request URL.
+func (this *RequestParser) utm(req *http.Request) map[string]string {
+	query := req.URL.Query()
+	utm := make(map[string]string)
+	for _, parameter := range utmParameters {
+		value := truncateMember(strings.TrimSpace(query.Get("utm_" + parameter)))
+		if value != "" {
+			utm[parameter] = value
+		}
+	}
+	return utm
+}
+
+// optedOut tells whether the request asks not to be tracked, through either
+// Do Not Track or Global Privacy Control.
+func optedOut(req *http.Request) bool {
+	return strings.TrimSpace(req.Header.Get("Dnt")) == "1" || strings.TrimSpace(req.Header.Get("Sec-Gpc")) == "1"
+}
+
+// truncateIp zeroes the host part of an address, keeping the first 24 bits
+// of IPv4 addresses and 48 bits of IPv6 ones.
+func truncateIp(ip string) string {
+	address := net.ParseIP(ip)
+	if address == nil {
+		return ip
+	} else if v4 := address.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return address.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// bot returns the first bot signature found on the given user agent.
+func (this *RequestParser) bot(userAgent string) (string, bool) {
+	userAgent = strings.ToLower(userAgent)
+	for _, signature := range this.BotSignatures {
+		if strings.Contains(userAgent, strings.ToLower(signature)) {
+			return signature, true
+		}
+	}
+	return "", false
+}
+
+// MajorVersion returns the browser name along with the major version, such
+// as "Chrome 31".
+func (this *Request) MajorVersion() string {
+	version := this.Version
+	if i := strings.Index(version, "."); i != -1 {
+		version = version[:i]
+	}
+	return strings.TrimSpace(this.Browser + " " + version)
+}
+
+// device classifies the client as a bot, tablet, mobile or desktop device.
+func device(userAgent string, bot bool, mobile bool) string {
+	switch {
+	case bot:
+		return "bot"
+	case strings.Contains(userAgent, "iPad"), strings.Contains(userAgent, "Tablet"),
+		strings.Contains(userAgent, "Android") && !strings.Contains(userAgent, "Mobile"):
+		return "tablet"
+	case mobile:
+		return "mobile"
+	}
+	return "desktop"
+}
+
+// ip returns the address of the client. Headers set by proxies are only
+// looked at when the request comes from a trusted proxy, and are walked from
+// the closest hop backwards, so clients can't fake an address of their own.
+func (this *RequestParser) ip(req *http.Request) (string, error) {
+	ip := parseAddress(req.RemoteAddr)
+	if ip == nil {
+		return "", errors.New(fmt.Sprintf("Could not obtain IP address from request: %s", req.RemoteAddr))
+	}
+
+	if this.trusted(ip) {
+		var hops []string
+		if forwarded := req.Header["Forwarded"]; len(forwarded) > 0 {
+			hops = forwardedFor(forwarded)
+		} else if forwarded := req.Header["X-Forwarded-For"]; len(forwarded) > 0 {
+			for _, header := range forwarded {
+				hops = append(hops, strings.Split(header, ",")...)
+			}
+		} else if realIp := req.Header.Get("X-Real-Ip"); realIp != "" {
+			hops = []string{realIp}
+		}
+
+		for i := len(hops) - 1; i >= 0 && this.trusted(ip); i-- {
+			hop := parseAddress(hops[i])
+			if hop == nil {
+				// Hidden or garbled, so the last known hop is as far as we can go
+				break
+			}
+			ip = hop
 		}
-	} else if forwarded != "" {
-		// X-Forwarded-For is potentially a list of addresses separated with ","
-		parts := strings.Split(forwarded, ",")
-		// TODO: should return first non-local address 
-		ip = parts[0]
 	}
 
-	ip = strings.TrimSpace(ip)
-	if ip == "" {
-		return "", errors.New("Could not obtain IP address from request")
-	} else if ip == "[::1]" {
-		// TODO: faked request
-		ip = "190.50.75.97"
-		//return "", nil
+	if ip.IsLoopback() && this.DevIp != "" {
+		return this.DevIp, nil
 	}
 
-	location := this.gi.GetLocationByIP(ip)
-	if location == nil {
-		return "", nil
+	return ip.String(), nil
+}
+
+// trusted tells whether the given address belongs to a trusted proxy.
+func (this *RequestParser) trusted(ip net.IP) bool {
+	for _, network := range this.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
 	}
-	return location.CountryCode, nil
+	return false
+}
+
+// forwardedFor returns the for= addresses on RFC 7239 Forwarded headers, from
+// the farthest hop to the closest one.
+func forwardedFor(headers []string) (hops []string) {
+	for _, header := range headers {
+		for _, element := range strings.Split(header, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				i := strings.Index(pair, "=")
+				if i != -1 && strings.EqualFold(strings.TrimSpace(pair[:i]), "for") {
+					hops = append(hops, strings.Trim(strings.TrimSpace(pair[i+1:]), "\""))
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// parseAddress parses an IP address, which may come along with a port,
+// between brackets, or with an IPv6 zone that is left out.
+func parseAddress(address string) net.IP {
+	address = strings.TrimSpace(address)
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	address = strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+	if i := strings.Index(address, "%"); i != -1 {
+		address = address[:i]
+	}
+	return net.ParseIP(address)
+}
+
+// ParseNetworks parses a comma separated list of networks in CIDR notation,
+// taking single addresses as networks of their own.
+func ParseNetworks(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, value := range strings.Split(list, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, errors.New(fmt.Sprintf("Invalid address: %s", value))
+			}
+			if ip.To4() != nil {
+				value += "/32"
+			} else {
+				value += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func (this *RequestParser) geo(ip string) (*Location, error) {
+	address := net.ParseIP(ip)
+	if address == nil {
+		return nil, errors.New(fmt.Sprintf("Invalid IP address: %s", ip))
+	}
+
+	this.geoLock.RLock()
+	defer this.geoLock.RUnlock()
+	if this.geoProvider == nil {
+		return nil, nil
+	}
+	return this.geoProvider.Locate(address)
+}
+
+// visitor returns an anonymous fingerprint identifying the visitor behind
+// the given IP address and user agent.
+func (this *RequestParser) visitor(ip string, userAgent string) string {
+	hash := sha256.New()
+	io.WriteString(hash, this.Salt+"\n"+ip+"\n"+userAgent)
+	return hex.EncodeToString(hash.Sum(nil)[:16])
 }
 
 func (this *RequestParser) Browser(req *http.Request) (bot bool, mobile bool, os string, browser string, version string) {
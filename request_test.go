@@ -0,0 +1,225 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseAddress(t *testing.T) {
+	tests := []struct {
+		address  string
+		expected string
+	}{
+		{"203.0.113.7", "203.0.113.7"},
+		{"203.0.113.7:8080", "203.0.113.7"},
+		{" 203.0.113.7 ", "203.0.113.7"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"[2001:db8::1]", "2001:db8::1"},
+		{"[2001:db8::1]:4711", "2001:db8::1"},
+		{"fe80::1%eth0", "fe80::1"},
+		{"[fe80::1%eth0]:80", "fe80::1"},
+		{"::ffff:203.0.113.7", "203.0.113.7"},
+		{"_hidden", ""},
+		{"unknown", ""},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		ip := parseAddress(test.address)
+		actual := ""
+		if ip != nil {
+			actual = ip.String()
+		}
+		if actual != test.expected {
+			t.Errorf("parseAddress(%q) = %q, expected %q", test.address, actual, test.expected)
+		}
+	}
+}
+
+func TestRequestParserIp(t *testing.T) {
+	proxies, err := ParseNetworks("10.0.0.0/8, 2001:db8:ffff::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parser := &RequestParser{TrustedProxies: proxies, DevIp: "198.51.100.10"}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     http.Header
+		expected   string
+	}{
+		{"direct", "203.0.113.7:1234", nil, "203.0.113.7"},
+		{"direct v6", "[2001:db8::2]:1234", nil, "2001:db8::2"},
+		{"untrusted forwarded for", "203.0.113.7:1234", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "203.0.113.7"},
+		{"untrusted forwarded", "203.0.113.7:1234", http.Header{"Forwarded": {"for=198.51.100.1"}}, "203.0.113.7"},
+		{"trusted forwarded for", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"203.0.113.7"}}, "203.0.113.7"},
+		{"trusted forwarded for v6 proxy", "[2001:db8:ffff::1]:1234", http.Header{"X-Forwarded-For": {"203.0.113.7"}}, "203.0.113.7"},
+		{"spoofed forwarded for", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.1, 203.0.113.7"}}, "203.0.113.7"},
+		{"chained proxies", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"203.0.113.7, 10.0.0.2"}}, "203.0.113.7"},
+		{"repeated headers", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"203.0.113.7", "10.0.0.2"}}, "203.0.113.7"},
+		{"all trusted", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}}, "10.0.0.3"},
+		{"garbled forwarded for", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"203.0.113.7, garbage"}}, "10.0.0.1"},
+		{"forwarded", "10.0.0.1:1234", http.Header{"Forwarded": {"for=203.0.113.7;proto=https"}}, "203.0.113.7"},
+		{"forwarded v6", "10.0.0.1:1234", http.Header{"Forwarded": {"for=\"[2001:db8::1]:4711\""}}, "2001:db8::1"},
+		{"forwarded chain", "10.0.0.1:1234", http.Header{"Forwarded": {"for=198.51.100.1, For=203.0.113.7;by=10.0.0.1, for=10.0.0.2"}}, "203.0.113.7"},
+		{"forwarded hidden", "10.0.0.1:1234", http.Header{"Forwarded": {"for=_hidden"}}, "10.0.0.1"},
+		{"forwarded over forwarded for", "10.0.0.1:1234", http.Header{"Forwarded": {"for=203.0.113.7"}, "X-Forwarded-For": {"198.51.100.1"}}, "203.0.113.7"},
+		{"real ip", "10.0.0.1:1234", http.Header{"X-Real-Ip": {"203.0.113.7"}}, "203.0.113.7"},
+		{"development", "127.0.0.1:1234", nil, "198.51.100.10"},
+		{"development v6", "[::1]:1234", nil, "198.51.100.10"},
+	}
+
+	for _, test := range tests {
+		req := &http.Request{RemoteAddr: test.remoteAddr, Header: test.header}
+		if req.Header == nil {
+			req.Header = http.Header{}
+		}
+
+		actual, err := parser.ip(req)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if actual != test.expected {
+			t.Errorf("%s: got %q, expected %q", test.name, actual, test.expected)
+		}
+	}
+
+	if _, err := parser.ip(&http.Request{RemoteAddr: "garbage", Header: http.Header{}}); err == nil {
+		t.Error("Expected an error for an invalid remote address")
+	}
+}
+
+func TestTruncateIp(t *testing.T) {
+	tests := []struct {
+		ip       string
+		expected string
+	}{
+		{"203.0.113.7", "203.0.113.0"},
+		{"203.0.113.0", "203.0.113.0"},
+		{"::ffff:203.0.113.7", "203.0.113.0"},
+		{"2001:db8:1234:5678::1", "2001:db8:1234::"},
+		{"2001:db8::1", "2001:db8::"},
+		{"::1", "::"},
+		{"garbage", "garbage"},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		if actual := truncateIp(test.ip); actual != test.expected {
+			t.Errorf("truncateIp(%q) = %q, expected %q", test.ip, actual, test.expected)
+		}
+	}
+}
+
+// geoRecord encodes a record of a legacy database, pointing either to
+// another node or to a country.
+func geoRecord(value int) []byte {
+	return []byte{byte(value), byte(value >> 8), byte(value >> 16)}
+}
+
+// geoCountry returns the record value of a country on legacy databases.
+func geoCountry(t *testing.T, code string) int {
+	for i, country := range geoCountryCodes {
+		if country == code {
+			return geoCountryBegin + i
+		}
+	}
+	t.Fatalf("Unknown country %s", code)
+	return 0
+}
+
+// writeGeoIPv6 writes a database splitting the address space on its first
+// two bits: 0 is US, 10 is DE and 11 is unknown.
+func writeGeoIPv6(t *testing.T, dir string, edition byte) string {
+	var data []byte
+	data = append(data, geoRecord(geoCountry(t, "US"))...)
+	data = append(data, geoRecord(1)...)
+	data = append(data, geoRecord(geoCountry(t, "DE"))...)
+	data = append(data, geoRecord(geoCountryBegin)...)
+	data = append(data, 0xFF, 0xFF, 0xFF, edition)
+
+	path := filepath.Join(dir, "GeoIPv6.dat")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestGeoIPv6(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geo6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	geo, err := LoadGeoIPv6(writeGeoIPv6(t, dir, geoCountryV6Edition))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip       string
+		expected string
+	}{
+		{"2001:db8::1", "US"},
+		{"7fff::1", "US"},
+		{"8000::1", "DE"},
+		{"bfff:ffff::1", "DE"},
+		{"c000::1", ""},
+		{"ffff::1", ""},
+	}
+
+	for _, test := range tests {
+		if actual := geo.Country(net.ParseIP(test.ip)); actual != test.expected {
+			t.Errorf("Country(%s) = %q, expected %q", test.ip, actual, test.expected)
+		}
+	}
+
+	if actual := geo.Country(nil); actual != "" {
+		t.Errorf("Country(nil) = %q, expected nothing", actual)
+	}
+}
+
+func TestLoadGeoIPv6Edition(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geo6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Editions may be stored with an offset of 105
+	tests := []struct {
+		edition byte
+		valid   bool
+	}{
+		{geoCountryV6Edition, true},
+		{geoCountryV6Edition + 105, true},
+		{1, false},
+		{2, false},
+	}
+
+	for _, test := range tests {
+		_, err := LoadGeoIPv6(writeGeoIPv6(t, dir, test.edition))
+		if test.valid && err != nil {
+			t.Errorf("Edition %d: %s", test.edition, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("Edition %d: expected an error", test.edition)
+		}
+	}
+
+	truncated := filepath.Join(dir, "truncated.dat")
+	if err := ioutil.WriteFile(truncated, []byte{0x01, 0x02}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadGeoIPv6(truncated); err == nil {
+		t.Error("Expected an error for a truncated database")
+	}
+
+	if _, err := LoadGeoIPv6(filepath.Join(dir, "missing.dat")); err == nil {
+		t.Error("Expected an error for a missing database")
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"strings"
+	"time"
+)
+
+// sqlMigrations holds the statements taking the schema from one version to
+// the next. Applied versions are recorded in schema_migrations, so new
+// versions must always be appended and never edited once released.
+var sqlMigrations = [][]string{
+	{
+		`CREATE TABLE links (
+			id VARCHAR(64) NOT NULL PRIMARY KEY,
+			destination TEXT NOT NULL,
+			created TIMESTAMP NOT NULL
+		)`,
+		`CREATE TABLE clicks (
+			link_id VARCHAR(64) NOT NULL,
+			dimension VARCHAR(32) NOT NULL,
+			period VARCHAR(8) NOT NULL,
+			bucket VARCHAR(32) NOT NULL,
+			member VARCHAR(255) NOT NULL,
+			hits INTEGER NOT NULL,
+			PRIMARY KEY (link_id, dimension, period, bucket, member)
+		)`,
+	},
+	{
+		`CREATE TABLE visitors (
+			link_id VARCHAR(64) NOT NULL,
+			dimension VARCHAR(32) NOT NULL,
+			period VARCHAR(8) NOT NULL,
+			bucket VARCHAR(32) NOT NULL,
+			visitor VARCHAR(64) NOT NULL,
+			PRIMARY KEY (link_id, dimension, period, bucket, visitor)
+		)`,
+	},
+	{
+		`ALTER TABLE links ADD COLUMN parameters TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE links ADD COLUMN passthrough BOOLEAN NOT NULL DEFAULT FALSE`,
+		`ALTER TABLE links ADD COLUMN precedence VARCHAR(8) NOT NULL DEFAULT 'link'`,
+	},
+}
+
+// SqlStore keeps URLs on a links table, and statistics on a clicks table
+// with a row per dimension, period, time bucket and member. Observed
+// visitors get a row of their own on the visitors table.
+type SqlStore struct {
+	db     *sql.DB
+	driver string
+}
+
+func NewSqlStore(driver string, dsn string) (*SqlStore, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if driver == "sqlite3" {
+		// SQLite allows a single writer, and every connection to :memory:
+		// would otherwise get a database of its own
+		db.SetMaxOpenConns(1)
+	}
+
+	store := &SqlStore{db: db, driver: driver}
+	if err := store.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (this *SqlStore) Exists(id string) (bool, error) {
+	var total int
+	err := this.db.QueryRow(this.query("SELECT COUNT(*) FROM links WHERE id = ?"), id).Scan(&total)
+	return total > 0, err
+}
+
+func (this *SqlStore) Load(id string) (*Url, error) {
+	url := &Url{Id: id}
+	err := this.db.QueryRow(this.query("SELECT destination, created, parameters, passthrough, precedence FROM links WHERE id = ?"), id).
+		Scan(&url.Destination, &url.Created, &url.Parameters, &url.Passthrough, &url.Precedence)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return url, nil
+}
+
+func (this *SqlStore) Save(url *Url) error {
+	_, err := this.db.Exec(this.query(`INSERT INTO links (id, destination, created, parameters, passthrough, precedence) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET destination = excluded.destination, created = excluded.created,
+			parameters = excluded.parameters, passthrough = excluded.passthrough, precedence = excluded.precedence`),
+		url.Id, url.Destination, url.Created.UTC(), url.Parameters, url.Passthrough, url.Precedence)
+	return err
+}
+
+func (this *SqlStore) Delete(id string) error {
+	_, err := this.db.Exec(this.query("DELETE FROM links WHERE id = ?"), id)
+	return err
+}
+
+func (this *SqlStore) Incr(counters []Counter) error {
+	tx, err := this.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(this.query(`INSERT INTO clicks (link_id, dimension, period, bucket, member, hits) VALUES (?, ?, ?, ?, ?, 1)
+		ON CONFLICT (link_id, dimension, period, bucket, member) DO UPDATE SET hits = clicks.hits + 1`))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, counter := range counters {
+		period, bucket := splitKey(counter.Key)
+		if _, err := stmt.Exec(counter.Id, counter.Dimension, period, bucket, counter.Member); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (this *SqlStore) Counts(counters []Counter) ([]int, error) {
+	totals := make([]int, len(counters))
+	if len(counters) == 0 {
+		return totals, nil
+	}
+
+	stmt, err := this.db.Prepare(this.query(`SELECT hits FROM clicks
+		WHERE link_id = ? AND dimension = ? AND period = ? AND bucket = ? AND member = ?`))
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	for i, counter := range counters {
+		period, bucket := splitKey(counter.Key)
+		err := stmt.QueryRow(counter.Id, counter.Dimension, period, bucket, counter.Member).Scan(&totals[i])
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+	}
+
+	return totals, nil
+}
+
+func (this *SqlStore) Members(id string, dimension string, key string) (Stats, error) {
+	period, bucket := splitKey(key)
+	rows, err := this.db.Query(this.query(`SELECT member, hits FROM clicks
+		WHERE link_id = ? AND dimension = ? AND period = ? AND bucket = ?`),
+		id, dimension, period, bucket)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stats Stats
+	for rows.Next() {
+		stat := new(Stat)
+		if err := rows.Scan(&stat.Name, &stat.Value); err != nil {
+			return nil, err
+		}
+		stats = append(stats, stat)
+	}
+
+	return stats, rows.Err()
+}
+
+func (this *SqlStore) Observe(counters []Counter) error {
+	tx, err := this.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(this.query(`INSERT INTO visitors (link_id, dimension, period, bucket, visitor) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (link_id, dimension, period, bucket, visitor) DO NOTHING`))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, counter := range counters {
+		period, bucket := splitKey(counter.Key)
+		if _, err := stmt.Exec(counter.Id, counter.Dimension, period, bucket, counter.Member); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (this *SqlStore) Distinct(groups [][]Counter) ([]int, error) {
+	totals := make([]int, len(groups))
+	for i, group := range groups {
+		if len(group) == 0 {
+			continue
+		}
+
+		conditions := make([]string, len(group))
+		args := []interface{}{group[0].Id, group[0].Dimension}
+		for j, counter := range group {
+			period, bucket := splitKey(counter.Key)
+			conditions[j] = "(period = ? AND bucket = ?)"
+			args = append(args, period, bucket)
+		}
+
+		query := `SELECT COUNT(DISTINCT visitor) FROM visitors
+			WHERE link_id = ? AND dimension = ? AND (` + strings.Join(conditions, " OR ") + ")"
+		if err := this.db.QueryRow(this.query(query), args...).Scan(&totals[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return totals, nil
+}
+
+func (this *SqlStore) Compact(retention Retention) error {
+	for period, layout := range periodLayouts {
+		if retention[period] <= 0 {
+			continue
+		}
+
+		// Buckets are zero padded, so they sort like the moments they stand for
+		before := time.Now().Add(-retention[period]).UTC().Format(layout)
+		for _, table := range []string{"clicks", "visitors"} {
+			_, err := this.db.Exec(this.query("DELETE FROM "+table+" WHERE period = ? AND bucket < ?"), period, before)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (this *SqlStore) Close() error {
+	return this.db.Close()
+}
+
+// migrate applies, each on its own transaction, every schema version not yet
+// recorded in schema_migrations.
+func (this *SqlStore) migrate() error {
+	_, err := this.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER NOT NULL PRIMARY KEY,
+		applied TIMESTAMP NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+
+	var current int
+	err = this.db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current)
+	if err != nil {
+		return err
+	}
+
+	for i := current; i < len(sqlMigrations); i++ {
+		tx, err := this.db.Begin()
+		if err != nil {
+			return err
+		}
+
+		for _, statement := range sqlMigrations[i] {
+			if _, err := tx.Exec(statement); err != nil {
+				tx.Rollback()
+				return errors.New(fmt.Sprintf("Migration %d failed: %s", i+1, err))
+			}
+		}
+
+		_, err = tx.Exec(this.query("INSERT INTO schema_migrations (version, applied) VALUES (?, ?)"), i+1, time.Now().UTC())
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// query adapts the ? placeholders used throughout the store to the ones
+// expected by the driver.
+func (this *SqlStore) query(query string) string {
+	if this.driver != "postgres" {
+		return query
+	}
+
+	parts := strings.Split(query, "?")
+	query = parts[0]
+	for i, part := range parts[1:] {
+		query += fmt.Sprintf("$%d", i+1) + part
+	}
+	return query
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Counter identifies a single statistics counter of a short URL, such as
+// the total hits for a day or the hits coming from a given country.
+type Counter struct {
+	Id        string
+	Dimension string
+	Key       string
+	Member    string
+}
+
+// Plain tells whether the counter is a plain one rather than one of the
+// members of a dimension.
+func (this Counter) Plain() bool {
+	return plainDimensions[this.Dimension]
+}
+
+// Store is the persistence layer for short URLs and their statistics.
+type Store interface {
+	Exists(id string) (bool, error)
+	Load(id string) (*Url, error)
+	Save(url *Url) error
+	Delete(id string) error
+
+	// Incr increments every given counter by one. Either every counter is
+	// incremented or, on error, none of them is.
+	Incr(counters []Counter) error
+
+	// Counts returns the value of each given counter, 0 for missing ones.
+	Counts(counters []Counter) ([]int, error)
+
+	// Members returns every member recorded for the given dimension and key.
+	Members(id string, dimension string, key string) (Stats, error)
+
+	// Observe adds the member of each counter to the set of distinct members
+	// seen for its dimension and key.
+	Observe(counters []Counter) error
+
+	// Distinct returns, for each group of counters, how many distinct members
+	// were observed across all of them, ignoring the member of the counters.
+	// Stores may approximate it.
+	Distinct(groups [][]Counter) ([]int, error)
+
+	// Compact drops every counter and set of distinct members past the given
+	// retention. Stores able to expire them on their own may do nothing.
+	Compact(retention Retention) error
+
+	Close() error
+}
+
+func NewStore(name string) (Store, error) {
+	switch name {
+	case "redis":
+		return NewRedisStore(settings.RedisUrl, settings.RedisPrefix), nil
+	case "memory":
+		return NewMemoryStore(settings.Snapshot)
+	case "bolt":
+		return NewBoltStore(settings.BoltPath)
+	case "sql":
+		return NewSqlStore(settings.SqlDriver, settings.SqlDsn)
+	}
+	return nil, errors.New(fmt.Sprintf("Unknown store: %s", name))
+}
+
+// Compactor compacts the store every given interval, forever. Since every
+// hit increments its day, month and year counters along with the finer
+// ones, dropping expired minutes and hours loses no totals.
+func Compactor(interval time.Duration) {
+	for _ = range time.Tick(interval) {
+		if err := store.Compact(settings.Retention); err != nil {
+			log.Println(fmt.Sprintf("Could not compact statistics: %s", err))
+		}
+	}
+}